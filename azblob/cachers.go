@@ -7,6 +7,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"sync"
 	"time"
@@ -15,6 +16,10 @@ import (
 	"github.com/bradfitz/go-tool-cache/cachers"
 )
 
+// downloadRetries is how many times an interrupted blob download is
+// resumed, with a ranged request from where it stopped, before failing.
+const downloadRetries = 3
+
 func actionBlobName(actionID string) string {
 	return "action/" + actionID
 }
@@ -30,6 +35,12 @@ type CacheUpstream struct {
 	Endpoint    string
 	Container   string
 
+	// InlineMaxSize optionally specifies the size up to which outputs are
+	// also embedded in their action blobs, so that a Get needs one request.
+	// The output blob is still written, for HasOutput and older readers.
+	// If zero, nothing is embedded.
+	InlineMaxSize int64
+
 	mu           sync.Mutex
 	containerURL *azblob.ContainerURL
 }
@@ -84,9 +95,12 @@ func (c *CacheUpstream) GetAction(ctx context.Context, actionID string) (*cacher
 	blob := c.containerURL.NewBlobURL(actionBlobName(actionID))
 	resp, err := blob.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
 	if err != nil {
-		return nil, err // TODO: convert 404 to ErrNotFound
+		if isNotFound(err) {
+			return nil, cachers.ErrNotFound
+		}
+		return nil, err
 	}
-	body := resp.Body(azblob.RetryReaderOptions{})
+	body := resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: downloadRetries})
 	defer body.Close()
 
 	var av cachers.ActionValue
@@ -96,6 +110,11 @@ func (c *CacheUpstream) GetAction(ctx context.Context, actionID string) (*cacher
 	return &av, nil
 }
 
+// GetOutput returns the output blob's contents. If the connection fails
+// partway through, the body resumes with a ranged Download from where it
+// stopped, conditional on the blob's ETag, up to downloadRetries times.
+// As with HTTPRemote, that's within the one body: a download that fails
+// anyway starts from the beginning next time.
 func (c *CacheUpstream) GetOutput(ctx context.Context, outputID string) (body io.ReadCloser, err error) {
 	if err := c.Init(ctx); err != nil {
 		return nil, err
@@ -104,9 +123,12 @@ func (c *CacheUpstream) GetOutput(ctx context.Context, outputID string) (body io
 	blob := c.containerURL.NewBlobURL(outputBlobName(outputID))
 	resp, err := blob.Download(ctx, 0, 0, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
 	if err != nil {
-		return nil, err // TODO: convert 404 to ErrNotFound
+		if isNotFound(err) {
+			return nil, cachers.ErrNotFound
+		}
+		return nil, err
 	}
-	return resp.Body(azblob.RetryReaderOptions{}), nil
+	return resp.Body(azblob.RetryReaderOptions{MaxRetryRequests: downloadRetries}), nil
 }
 
 func (c *CacheUpstream) Put(ctx context.Context, actionID string, outputID string, size int64, body io.Reader) error {
@@ -114,6 +136,15 @@ func (c *CacheUpstream) Put(ctx context.Context, actionID string, outputID strin
 		return err
 	}
 
+	var data []byte
+	if size > 0 && size <= c.InlineMaxSize {
+		data = make([]byte, size)
+		if _, err := io.ReadFull(body, data); err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
 	if size > 0 {
 		// TODO: lease blobs for writing?
 		outputBlob := c.containerURL.NewBlockBlobURL(outputBlobName(outputID))
@@ -126,10 +157,51 @@ func (c *CacheUpstream) Put(ctx context.Context, actionID string, outputID strin
 		}
 	}
 
-	ac := &cachers.ActionValue{
+	return c.putAction(ctx, actionID, &cachers.ActionValue{
 		OutputID: outputID,
 		Size:     size,
+		Data:     data,
+	})
+}
+
+func (c *CacheUpstream) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	if err := c.Init(ctx); err != nil {
+		return false, err
+	}
+
+	blob := c.containerURL.NewBlobURL(outputBlobName(outputID))
+	_, err := blob.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
 	}
+	return true, nil
+}
+
+func (c *CacheUpstream) PutAction(ctx context.Context, actionID string, outputID string, size int64) error {
+	if err := c.Init(ctx); err != nil {
+		return err
+	}
+	if size > 0 {
+		// Don't record an action whose output has been deleted since the
+		// caller checked for it.
+		has, err := c.HasOutput(ctx, outputID)
+		if err != nil {
+			return err
+		}
+		if !has {
+			return cachers.ErrNotFound
+		}
+	}
+	return c.putAction(ctx, actionID, &cachers.ActionValue{
+		OutputID: outputID,
+		Size:     size,
+	})
+}
+
+func (c *CacheUpstream) putAction(ctx context.Context, actionID string, ac *cachers.ActionValue) error {
 	acBody := bytes.NewBuffer(nil)
 	if err := json.NewEncoder(acBody).Encode(ac); err != nil {
 		return err
@@ -145,3 +217,14 @@ func (c *CacheUpstream) Put(ctx context.Context, actionID string, outputID strin
 
 	return nil
 }
+
+// isNotFound reports whether err is a storage error for a missing blob.
+// HEAD responses have no body to carry a service code, so the status code is
+// checked instead.
+func isNotFound(err error) bool {
+	var serr azblob.StorageError
+	if !errors.As(err, &serr) {
+		return false
+	}
+	return serr.Response() != nil && serr.Response().StatusCode == http.StatusNotFound
+}
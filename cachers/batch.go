@@ -0,0 +1,221 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultMaxBatchSize is the default for HTTPRemote.MaxBatchSize.
+const defaultMaxBatchSize = 100
+
+// MaxBatchGetActions is the most action IDs go-cacher-server accepts in a
+// batch lookup. HTTPRemote never sends more.
+const MaxBatchGetActions = 1000
+
+// batchTimeout bounds a batch request, which isn't tied to any one
+// caller's context. It's cancelled early once all its callers are gone.
+const batchTimeout = time.Minute
+
+// actionBatcher coalesces concurrent HTTPRemote.GetAction calls into
+// /actions:batchGet requests.
+type actionBatcher struct {
+	mu          sync.Mutex
+	pending     map[string][]*batchWaiter // guarded by mu
+	timer       *time.Timer               // guarded by mu; fires to send pending
+	unsupported bool                      // guarded by mu; server lacks the batch endpoint
+}
+
+// batchWaiter is a GetAction call waiting for its batch.
+type batchWaiter struct {
+	ctx context.Context
+	ch  chan batchResult
+}
+
+type batchResult struct {
+	av  *ActionValue
+	err error
+
+	// unbatched means the batch couldn't be sent, and the caller should
+	// do its own single lookup.
+	unbatched bool
+}
+
+// getActionBatched looks up actionID as part of a batch, sending the batch
+// when BatchWindow passes or MaxBatchSize lookups have accumulated.
+func (r *HTTPRemote) getActionBatched(ctx context.Context, actionID string) (*ActionValue, error) {
+	b := &r.batcher
+	bw := &batchWaiter{ctx: ctx, ch: make(chan batchResult, 1)}
+
+	b.mu.Lock()
+	if b.unsupported {
+		b.mu.Unlock()
+		return r.getActionSingle(ctx, actionID)
+	}
+	if b.pending == nil {
+		b.pending = make(map[string][]*batchWaiter)
+	}
+	b.pending[actionID] = append(b.pending[actionID], bw)
+	if len(b.pending) >= r.maxBatchSize() {
+		batch := b.takeLocked()
+		go r.sendBatch(batch)
+	} else if b.timer == nil {
+		b.timer = time.AfterFunc(r.BatchWindow, func() {
+			b.mu.Lock()
+			batch := b.takeLocked()
+			b.mu.Unlock()
+			r.sendBatch(batch)
+		})
+	}
+	b.mu.Unlock()
+
+	select {
+	case res := <-bw.ch:
+		if res.unbatched {
+			return r.getActionSingle(ctx, actionID)
+		}
+		return res.av, res.err
+	case <-ctx.Done():
+		b.remove(actionID, bw)
+		return nil, ctx.Err()
+	}
+}
+
+// maxBatchSize returns how many lookups a batch may hold.
+func (r *HTTPRemote) maxBatchSize() int {
+	n := r.MaxBatchSize
+	if n <= 0 {
+		n = defaultMaxBatchSize
+	}
+	if n > MaxBatchGetActions {
+		n = MaxBatchGetActions
+	}
+	return n
+}
+
+// takeLocked removes and returns the pending lookups. b.mu must be held.
+func (b *actionBatcher) takeLocked() map[string][]*batchWaiter {
+	batch := b.pending
+	b.pending = nil
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	return batch
+}
+
+// remove drops bw from the pending lookups of actionID, if the batch
+// hasn't been sent yet.
+func (b *actionBatcher) remove(actionID string, bw *batchWaiter) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bws := b.pending[actionID]
+	for i, w := range bws {
+		if w == bw {
+			bws = append(bws[:i:i], bws[i+1:]...)
+			break
+		}
+	}
+	if len(bws) == 0 {
+		delete(b.pending, actionID)
+	} else {
+		b.pending[actionID] = bws
+	}
+}
+
+func (r *HTTPRemote) sendBatch(batch map[string][]*batchWaiter) {
+	if len(batch) == 0 {
+		return
+	}
+	reply := func(res func(actionID string) batchResult) {
+		for actionID, bws := range batch {
+			for _, bw := range bws {
+				bw.ch <- res(actionID)
+			}
+		}
+	}
+
+	// Abandon the request once every caller waiting for it has given up.
+	ctx, cancel := context.WithTimeout(context.Background(), batchTimeout)
+	defer cancel()
+	go func() {
+		for _, bws := range batch {
+			for _, bw := range bws {
+				select {
+				case <-bw.ctx.Done():
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+		cancel()
+	}()
+
+	req := BatchGetActionsRequest{ActionIDs: make([]string, 0, len(batch))}
+	for actionID := range batch {
+		req.ActionIDs = append(req.ActionIDs, actionID)
+	}
+	resp, err := r.postBatch(ctx, &req)
+	if err != nil {
+		if r.Verbose {
+			log.Printf("batch lookup of %d actions: %v", len(batch), err)
+		}
+		reply(func(string) batchResult { return batchResult{unbatched: true} })
+		return
+	}
+	reply(func(actionID string) batchResult {
+		if av, ok := resp.Actions[actionID]; ok && av != nil {
+			return batchResult{av: av}
+		}
+		return batchResult{err: errNotFound}
+	})
+}
+
+func (r *HTTPRemote) postBatch(ctx context.Context, breq *BatchGetActionsRequest) (*BatchGetActionsResponse, error) {
+	reqj, err := json.Marshal(breq)
+	if err != nil {
+		return nil, err
+	}
+	req, err := r.newRequest(ctx, "POST", "/actions:batchGet", bytes.NewReader(reqj))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := r.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		err := newStatusError(res)
+		if batchUnsupported(err.(*StatusError)) {
+			// Stop trying.
+			r.batcher.mu.Lock()
+			r.batcher.unsupported = true
+			r.batcher.mu.Unlock()
+		}
+		return nil, err
+	}
+	var bres BatchGetActionsResponse
+	if err := json.NewDecoder(res.Body).Decode(&bres); err != nil {
+		return nil, err
+	}
+	return &bres, nil
+}
+
+// batchUnsupported reports whether se says the server doesn't know the
+// batch endpoint, rather than that something was wrong with one batch.
+// Servers from before it reply to any POST with 400 "bad method".
+func batchUnsupported(se *StatusError) bool {
+	switch se.StatusCode {
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return true
+	case http.StatusBadRequest:
+		return se.Body == "bad method"
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package cachers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// batchServer is a go-cacher-server stand-in for batch lookups.
+type batchServer struct {
+	batchStatus int    // if non-zero, the status to reply to batches with
+	batchBody   string // and its body
+
+	batches, singles atomic.Int32
+	largest          atomic.Int32 // most action IDs in one batch
+}
+
+func (bs *batchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/actions:batchGet":
+		bs.batches.Add(1)
+		if bs.batchStatus != 0 {
+			http.Error(w, bs.batchBody, bs.batchStatus)
+			return
+		}
+		var req BatchGetActionsRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if n := int32(len(req.ActionIDs)); n > bs.largest.Load() {
+			bs.largest.Store(n)
+		}
+		res := BatchGetActionsResponse{Actions: map[string]*ActionValue{}}
+		for _, id := range req.ActionIDs {
+			res.Actions[id] = &ActionValue{OutputID: "out-" + id, Size: 1}
+		}
+		json.NewEncoder(w).Encode(&res)
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/action/"):
+		bs.singles.Add(1)
+		id := strings.TrimPrefix(r.URL.Path, "/action/")
+		json.NewEncoder(w).Encode(&ActionValue{OutputID: "out-" + id, Size: 1})
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// lookupAll looks up n actions concurrently through r.
+func lookupAll(t *testing.T, r *HTTPRemote, n int) {
+	t.Helper()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			av, err := r.GetAction(context.Background(), id)
+			if err != nil || av.OutputID != "out-"+id {
+				t.Errorf("GetAction(%s) = %+v, %v", id, av, err)
+			}
+		}(testActionID(string(rune('a'+i%26))) + strings.Repeat("0", 2*(i/26)))
+	}
+	wg.Wait()
+}
+
+func TestBatchFallback(t *testing.T) {
+	tests := []struct {
+		name            string
+		status          int
+		body            string
+		wantUnsupported bool
+	}{
+		{"old server", http.StatusBadRequest, "bad method", true},
+		{"no endpoint", http.StatusNotFound, "not found", true},
+		{"method not allowed", http.StatusMethodNotAllowed, "", true},
+		{"bad batch", http.StatusBadRequest, "bad action ID", false},
+		{"server error", http.StatusInternalServerError, "boom", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs := &batchServer{batchStatus: tt.status, batchBody: tt.body}
+			srv := httptest.NewServer(bs)
+			defer srv.Close()
+			r := &HTTPRemote{BaseURL: srv.URL, BatchWindow: 10 * time.Millisecond}
+
+			lookupAll(t, r, 3)
+			if got := bs.singles.Load(); got != 3 {
+				t.Errorf("got %d single lookups after a failed batch; want 3", got)
+			}
+			lookupAll(t, r, 3)
+			wantBatches := int32(2)
+			if tt.wantUnsupported {
+				wantBatches = 1
+			}
+			if got := bs.batches.Load(); got != wantBatches {
+				t.Errorf("got %d batches; want %d", got, wantBatches)
+			}
+		})
+	}
+}
+
+func TestBatchSizeCapped(t *testing.T) {
+	bs := new(batchServer)
+	srv := httptest.NewServer(bs)
+	defer srv.Close()
+	r := &HTTPRemote{BaseURL: srv.URL, BatchWindow: time.Second, MaxBatchSize: 5000}
+	lookupAll(t, r, MaxBatchGetActions+10)
+	if got := bs.largest.Load(); got > MaxBatchGetActions {
+		t.Errorf("sent a batch of %d; want at most %d", got, MaxBatchGetActions)
+	}
+	if bs.singles.Load() != 0 {
+		t.Errorf("got %d single lookups; want 0", bs.singles.Load())
+	}
+}
+
+func TestBatchCallerCancel(t *testing.T) {
+	arrived := make(chan struct{})
+	var aborted atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The server only notices the client going away once it has read
+		// the request.
+		io.Copy(io.Discard, r.Body)
+		close(arrived)
+		select {
+		case <-r.Context().Done():
+			aborted.Store(true)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	r := &HTTPRemote{BaseURL: srv.URL, BatchWindow: time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := r.GetAction(ctx, testActionID("a"))
+		errc <- err
+	}()
+	<-arrived
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Errorf("GetAction error = %v; want context.Canceled", err)
+	}
+	for i := 0; i < 100 && !aborted.Load(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !aborted.Load() {
+		t.Errorf("batch request wasn't aborted when its only caller gave up")
+	}
+}
@@ -0,0 +1,173 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// BazelRemote is an Upstream for caches speaking Bazel's HTTP remote cache
+// protocol, such as bazel-remote or nginx with WebDAV: blobs are stored
+// under /cas/<sha256> and action results under /ac/<sha256>.
+//
+// Outputs go in the CAS, as cmd/go's output IDs are the SHA-256 of their
+// contents. Actions are stored in the AC as the JSON of an ActionValue
+// rather than as a Bazel ActionResult, so servers that validate AC entries
+// need that turned off (bazel-remote --disable_http_ac_validation).
+type BazelRemote struct {
+	// BaseURL is the base URL of the cache, like "http://localhost:8080".
+	// It may include a path prefix.
+	BaseURL string
+
+	// HTTPClient optionally specifies the http.Client to use.
+	// If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Verbose optionally specifies whether to log verbose messages.
+	Verbose bool
+
+	// BearerToken, or Username and Password, optionally specify the
+	// credentials to send with every request.
+	BearerToken string
+	Username    string
+	Password    string
+}
+
+var _ Upstream = (*BazelRemote)(nil)
+
+func (b *BazelRemote) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(b.BaseURL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if b.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+b.BearerToken)
+	} else if b.Username != "" {
+		req.SetBasicAuth(b.Username, b.Password)
+	}
+	return req, nil
+}
+
+func (b *BazelRemote) do(req *http.Request) (*http.Response, error) {
+	hc := b.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	res, err := hc.Do(req)
+	if err == nil && b.Verbose {
+		log.Printf("bazel: %s %s: %s", req.Method, req.URL.Path, res.Status)
+	}
+	return res, err
+}
+
+func (b *BazelRemote) GetAction(ctx context.Context, actionID string) (*ActionValue, error) {
+	req, err := b.newRequest(ctx, "GET", "/ac/"+actionID, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := b.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, errNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, newStatusError(res)
+	}
+	var av ActionValue
+	// Leave room for an inlined output, as go-cacher-server -bazel-paths
+	// may send.
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&av); err != nil {
+		return nil, fmt.Errorf("decoding AC entry %s: %w", actionID, err)
+	}
+	return &av, nil
+}
+
+func (b *BazelRemote) GetOutput(ctx context.Context, outputID string) (io.ReadCloser, error) {
+	req, err := b.newRequest(ctx, "GET", "/cas/"+outputID, nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := b.do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return nil, errNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		return nil, newStatusError(res)
+	}
+	return res.Body, nil
+}
+
+// Put uploads the output to the CAS, then records the action in the AC.
+func (b *BazelRemote) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	req, err := b.newRequest(ctx, "PUT", "/cas/"+outputID, body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if size == 0 {
+		req.Body = http.NoBody
+	}
+	if err := b.expectSuccess(req); err != nil {
+		return err
+	}
+	return b.PutAction(ctx, actionID, outputID, size)
+}
+
+func (b *BazelRemote) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	req, err := b.newRequest(ctx, "HEAD", "/cas/"+outputID, nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := b.do(req)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, newStatusError(res)
+}
+
+func (b *BazelRemote) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	avj, err := json.Marshal(&ActionValue{OutputID: outputID, Size: size})
+	if err != nil {
+		return err
+	}
+	req, err := b.newRequest(ctx, "PUT", "/ac/"+actionID, bytes.NewReader(avj))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return b.expectSuccess(req)
+}
+
+// expectSuccess sends req and checks for a 2xx status, which is what the
+// various Bazel caches reply to PUTs with.
+func (b *BazelRemote) expectSuccess(req *http.Request) error {
+	res, err := b.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return newStatusError(res)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeBazelCache is a minimal Bazel HTTP remote cache, storing blobs by
+// path under /ac/ and /cas/.
+type fakeBazelCache struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+	paths []string // "METHOD path" of each request
+	auth  []string // Authorization header of each request
+}
+
+func (f *fakeBazelCache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths = append(f.paths, r.Method+" "+r.URL.Path)
+	f.auth = append(f.auth, r.Header.Get("Authorization"))
+	if !strings.HasPrefix(r.URL.Path, "/ac/") && !strings.HasPrefix(r.URL.Path, "/cas/") {
+		http.Error(w, "bad path", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case "PUT":
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.blobs[r.URL.Path] = data
+	case "GET", "HEAD":
+		data, ok := f.blobs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	default:
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+	}
+}
+
+func TestBazelRemoteRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	fake := &fakeBazelCache{blobs: make(map[string][]byte)}
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	b := &BazelRemote{BaseURL: srv.URL + "/", Username: "user", Password: "pass"}
+
+	const data = "bazel output"
+	actionID, outputID := testActionID("a"), testOutput(data)
+	if _, err := b.GetAction(ctx, actionID); !errors.Is(err, errNotFound) {
+		t.Fatalf("GetAction before Put = %v; want not found", err)
+	}
+	if _, err := b.GetOutput(ctx, outputID); !errors.Is(err, errNotFound) {
+		t.Fatalf("GetOutput before Put = %v; want not found", err)
+	}
+	if has, err := b.HasOutput(ctx, outputID); has || err != nil {
+		t.Fatalf("HasOutput before Put = %v, %v; want false, nil", has, err)
+	}
+
+	if err := b.Put(ctx, actionID, outputID, int64(len(data)), strings.NewReader(data)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if got := string(fake.blobs["/cas/"+outputID]); got != data {
+		t.Errorf("CAS entry = %q; want %q", got, data)
+	}
+	av, err := b.GetAction(ctx, actionID)
+	if err != nil || av.OutputID != outputID || av.Size != int64(len(data)) {
+		t.Fatalf("GetAction = %+v, %v; want output %s of size %d", av, err, outputID, len(data))
+	}
+	body, err := b.GetOutput(ctx, outputID)
+	if err != nil {
+		t.Fatalf("GetOutput: %v", err)
+	}
+	got, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(got) != data {
+		t.Errorf("GetOutput body = %q, %v; want %q", got, err, data)
+	}
+	if has, err := b.HasOutput(ctx, outputID); !has || err != nil {
+		t.Errorf("HasOutput after Put = %v, %v; want true, nil", has, err)
+	}
+
+	// Another action with the same output only needs its AC entry.
+	other := testActionID("b")
+	if err := b.PutAction(ctx, other, outputID, int64(len(data))); err != nil {
+		t.Fatalf("PutAction: %v", err)
+	}
+	if av, err := b.GetAction(ctx, other); err != nil || av.OutputID != outputID {
+		t.Errorf("GetAction after PutAction = %+v, %v", av, err)
+	}
+
+	// Empty outputs are stored too.
+	emptyID := testOutput("")
+	if err := b.Put(ctx, testActionID("empty"), emptyID, 0, bytes.NewReader(nil)); err != nil {
+		t.Fatalf("Put of an empty output: %v", err)
+	}
+	if blob, ok := fake.blobs["/cas/"+emptyID]; !ok || len(blob) != 0 {
+		t.Errorf("empty CAS entry = %q, %v", blob, ok)
+	}
+
+	wantAuth := "Basic dXNlcjpwYXNz"
+	for i, a := range fake.auth {
+		if a != wantAuth {
+			t.Errorf("%s: Authorization %q; want %q", fake.paths[i], a, wantAuth)
+		}
+	}
+}
+
+func TestBazelRemoteServerError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "disk full", http.StatusInsufficientStorage)
+	}))
+	defer srv.Close()
+	b := &BazelRemote{BaseURL: srv.URL}
+	err := b.Put(context.Background(), testActionID("a"), testOutput("x"), 1, strings.NewReader("x"))
+	var se *StatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusInsufficientStorage || se.Path != "/cas/"+testOutput("x") {
+		t.Errorf("Put = %v; want a 507 StatusError for the CAS upload", err)
+	}
+}
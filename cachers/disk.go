@@ -19,11 +19,19 @@ type indexEntry struct {
 	OutputID  string `json:"o"`
 	Size      int64  `json:"n"`
 	TimeNanos int64  `json:"t"`
+	Uploader  string `json:"u,omitempty"`
 }
 
 type DiskCache struct {
 	Dir     string
 	Verbose bool
+
+	// CompressOutputs optionally specifies that new outputs are stored
+	// zstd-compressed, in o-<outputID>.zst files. cmd/go can't read such
+	// files, so this is only for servers, which can use StatOutput and
+	// NewDecoder to serve them. Outputs already stored uncompressed remain
+	// readable.
+	CompressOutputs bool
 }
 
 func (dc *DiskCache) Get(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
@@ -47,25 +55,85 @@ func (dc *DiskCache) Get(ctx context.Context, actionID string) (outputID, diskPa
 		// Protect against malicious non-hex OutputID on disk
 		return "", "", nil
 	}
-	return ie.OutputID, filepath.Join(dc.Dir, fmt.Sprintf("o-%v", ie.OutputID)), nil
+	return ie.OutputID, dc.outputFile(filepath.Join(dc.Dir, fmt.Sprintf("o-%v", ie.OutputID))), nil
+}
+
+// outputFile returns the path of the compressed variant of the output file
+// at file, if outputs are compressed and it exists, and otherwise file.
+func (dc *DiskCache) outputFile(file string) string {
+	if dc.CompressOutputs {
+		if _, err := os.Stat(file + zstdSuffix); err == nil {
+			return file + zstdSuffix
+		}
+	}
+	return file
+}
+
+var _ OutputStore = (*DiskCache)(nil)
+
+// OutputPath implements OutputStore.
+func (dc *DiskCache) OutputPath(ctx context.Context, outputID string) (diskPath string, err error) {
+	file := dc.OutputFilename(outputID)
+	if file == "" {
+		return "", fmt.Errorf("invalid output ID %q", outputID)
+	}
+	file = dc.outputFile(file)
+	fi, err := os.Stat(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", fmt.Errorf("output %s is not a regular file", outputID)
+	}
+	return file, nil
 }
 
 func (dc *DiskCache) OutputFilename(objectID string) string {
-	if len(objectID) < 4 || len(objectID) > 1000 {
+	if !validID(objectID) {
 		return ""
 	}
-	for i := range objectID {
-		b := objectID[i]
+	return filepath.Join(dc.Dir, fmt.Sprintf("o-%s", objectID))
+}
+
+// validID reports whether id looks like an action or output ID, so it's
+// safe to use in a file name.
+func validID(id string) bool {
+	if len(id) < 4 || len(id) > 1000 {
+		return false
+	}
+	for i := range id {
+		b := id[i]
 		if b >= '0' && b <= '9' || b >= 'a' && b <= 'f' {
 			continue
 		}
-		return ""
+		return false
 	}
-	return filepath.Join(dc.Dir, fmt.Sprintf("o-%s", objectID))
+	return true
 }
 
 func (dc *DiskCache) Put(ctx context.Context, actionID, objectID string, size int64, body io.Reader) (diskPath string, _ error) {
-	file := filepath.Join(dc.Dir, fmt.Sprintf("o-%s", objectID))
+	file, err := dc.PutOutput(ctx, objectID, size, body)
+	if err != nil {
+		return "", err
+	}
+	if err := dc.writeActionIndex(ctx, actionID, objectID, size); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+// PutOutput stores an output without recording any action as producing
+// it. If size is negative, the body may be of any size, and is stored
+// uncompressed, as StatOutput needs to know the size of compressed outputs
+// in advance.
+func (dc *DiskCache) PutOutput(ctx context.Context, objectID string, size int64, body io.Reader) (diskPath string, _ error) {
+	file := dc.OutputFilename(objectID)
+	if file == "" {
+		return "", fmt.Errorf("invalid output ID %q", objectID)
+	}
 
 	// Special case empty files; they're both common and easier to do race-free.
 	if size == 0 {
@@ -74,38 +142,96 @@ func (dc *DiskCache) Put(ctx context.Context, actionID, objectID string, size in
 			return "", err
 		}
 		zf.Close()
-	} else {
-		wrote, err := writeAtomic(file, body)
+	} else if dc.CompressOutputs && size > 0 {
+		file += zstdSuffix
+		_, err := writeAtomicFunc(file, func(w io.Writer) (int64, error) {
+			zw, err := NewEncoder(w, EncodingZstd, size)
+			if err != nil {
+				return 0, err
+			}
+			wrote, err := io.Copy(zw, body)
+			if err != nil {
+				return 0, err
+			}
+			if wrote != size {
+				return 0, fmt.Errorf("wrote %d bytes, expected %d", wrote, size)
+			}
+			return wrote, zw.Close()
+		})
 		if err != nil {
 			return "", err
 		}
-		if wrote != size {
-			return "", fmt.Errorf("wrote %d bytes, expected %d", wrote, size)
+	} else {
+		_, err := writeAtomicFunc(file, func(w io.Writer) (int64, error) {
+			wrote, err := io.Copy(w, body)
+			if err == nil && size >= 0 && wrote != size {
+				err = fmt.Errorf("wrote %d bytes, expected %d", wrote, size)
+			}
+			return wrote, err
+		})
+		if err != nil {
+			return "", err
 		}
 	}
+	return file, nil
+}
 
+// PutAction records actionID as producing objectID, which must already be
+// on disk with the given size.
+func (dc *DiskCache) PutAction(ctx context.Context, actionID, objectID string, size int64) (diskPath string, _ error) {
+	file := dc.OutputFilename(objectID)
+	if file == "" {
+		return "", fmt.Errorf("invalid output ID %q", objectID)
+	}
+	file = dc.outputFile(file)
+	diskSize, _, err := StatOutput(file)
+	if err != nil {
+		return "", err
+	}
+	if diskSize != size {
+		return "", fmt.Errorf("output %s has size %d on disk, expected %d", objectID, diskSize, size)
+	}
+	// Mark the output as recently used, so Purge keeps it.
+	now := time.Now()
+	os.Chtimes(file, now, now)
+	if err := dc.writeActionIndex(ctx, actionID, objectID, size); err != nil {
+		return "", err
+	}
+	return file, nil
+}
+
+func (dc *DiskCache) writeActionIndex(ctx context.Context, actionID, objectID string, size int64) error {
+	uploader, _ := ctx.Value(uploaderKey{}).(string)
 	ij, err := json.Marshal(indexEntry{
 		Version:   1,
 		OutputID:  objectID,
 		Size:      size,
 		TimeNanos: time.Now().UnixNano(),
+		Uploader:  uploader,
 	})
 	if err != nil {
-		return "", err
+		return err
 	}
 	actionFile := filepath.Join(dc.Dir, fmt.Sprintf("a-%s", actionID))
-	if _, err := writeAtomic(actionFile, bytes.NewReader(ij)); err != nil {
-		return "", err
-	}
-	return file, nil
+	_, err = writeAtomic(actionFile, bytes.NewReader(ij))
+	return err
 }
 
 func writeAtomic(dest string, r io.Reader) (int64, error) {
+	return writeAtomicFunc(dest, func(w io.Writer) (int64, error) {
+		return io.Copy(w, r)
+	})
+}
+
+// writeAtomicFunc calls write with a temporary file in dest's directory and,
+// if write succeeds, renames the file to dest. It returns what write
+// returns.
+func writeAtomicFunc(dest string, write func(io.Writer) (int64, error)) (int64, error) {
 	tf, err := os.CreateTemp(filepath.Dir(dest), filepath.Base(dest)+".*")
 	if err != nil {
 		return 0, err
 	}
-	size, err := io.Copy(tf, r)
+	size, err := write(tf)
 	if err != nil {
 		tf.Close()
 		os.Remove(tf.Name())
@@ -120,4 +246,4 @@ func writeAtomic(dest string, r io.Reader) (int64, error) {
 		return 0, err
 	}
 	return size, nil
-}
\ No newline at end of file
+}
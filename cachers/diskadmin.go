@@ -0,0 +1,200 @@
+package cachers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type uploaderKey struct{}
+
+// ContextWithUploader returns a copy of ctx that makes DiskCache record who
+// as the uploader of the actions it stores, for DiskEntry.Uploader.
+func ContextWithUploader(ctx context.Context, who string) context.Context {
+	return context.WithValue(ctx, uploaderKey{}, who)
+}
+
+// DiskEntry is the metadata of an action stored in a DiskCache.
+type DiskEntry struct {
+	ActionID string    `json:"actionID"`
+	OutputID string    `json:"outputID"`
+	Size     int64     `json:"size"`
+	Time     time.Time `json:"time"`               // when the action was stored
+	Uploader string    `json:"uploader,omitempty"` // from ContextWithUploader
+}
+
+// Entry returns the metadata of actionID, or nil if it's not in the cache.
+func (dc *DiskCache) Entry(actionID string) (*DiskEntry, error) {
+	if !validID(actionID) {
+		return nil, fmt.Errorf("invalid action ID %q", actionID)
+	}
+	ij, err := os.ReadFile(filepath.Join(dc.Dir, "a-"+actionID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return parseEntry(actionID, ij)
+}
+
+func parseEntry(actionID string, ij []byte) (*DiskEntry, error) {
+	var ie indexEntry
+	if err := json.Unmarshal(ij, &ie); err != nil {
+		return nil, fmt.Errorf("action %s: %v", actionID, err)
+	}
+	return &DiskEntry{
+		ActionID: actionID,
+		OutputID: ie.OutputID,
+		Size:     ie.Size,
+		Time:     time.Unix(0, ie.TimeNanos),
+		Uploader: ie.Uploader,
+	}, nil
+}
+
+// DeleteAction removes actionID from the cache. The output it refers to is
+// kept, as other actions may refer to it too. If actionID isn't in the
+// cache, the error satisfies errors.Is(err, fs.ErrNotExist).
+func (dc *DiskCache) DeleteAction(actionID string) error {
+	if !validID(actionID) {
+		return fmt.Errorf("invalid action ID %q", actionID)
+	}
+	return os.Remove(filepath.Join(dc.Dir, "a-"+actionID))
+}
+
+// DeleteOutput removes outputID from the cache, in all the forms it's
+// stored in, and returns the number of bytes freed. Actions referring to
+// it become misses. If outputID isn't in the cache, the error satisfies
+// errors.Is(err, fs.ErrNotExist).
+func (dc *DiskCache) DeleteOutput(outputID string) (freed int64, _ error) {
+	file := dc.OutputFilename(outputID)
+	if file == "" {
+		return 0, fmt.Errorf("invalid output ID %q", outputID)
+	}
+	found := false
+	for _, f := range []string{file, file + zstdSuffix} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return freed, err
+		}
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return freed, err
+		}
+		found = true
+		freed += fi.Size()
+	}
+	if !found {
+		return 0, &fs.PathError{Op: "remove", Path: file, Err: fs.ErrNotExist}
+	}
+	return freed, nil
+}
+
+// WalkEntries calls fn for each action in the cache, in no particular
+// order, until fn returns an error. Actions whose metadata can't be read
+// are skipped.
+func (dc *DiskCache) WalkEntries(fn func(*DiskEntry) error) error {
+	return dc.walkDir(func(de fs.DirEntry) error {
+		actionID, ok := strings.CutPrefix(de.Name(), "a-")
+		if !ok || !validID(actionID) {
+			return nil
+		}
+		ij, err := os.ReadFile(filepath.Join(dc.Dir, de.Name()))
+		if err != nil {
+			return nil // deleted since listed
+		}
+		e, err := parseEntry(actionID, ij)
+		if err != nil {
+			return nil
+		}
+		return fn(e)
+	})
+}
+
+// walkDir calls fn for each entry in dc.Dir, reading the directory in
+// chunks so huge caches don't need to be listed in memory at once.
+func (dc *DiskCache) walkDir(fn func(fs.DirEntry) error) error {
+	d, err := os.Open(dc.Dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	for {
+		des, err := d.ReadDir(1000)
+		for _, de := range des {
+			if err := fn(de); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// PurgeStats reports what DiskCache.Purge removed.
+type PurgeStats struct {
+	Actions int   `json:"actions"`
+	Outputs int   `json:"outputs"`
+	Bytes   int64 `json:"bytes"` // of outputs
+}
+
+// Purge removes the actions stored before the given time, and the outputs
+// last written or reused before then that no remaining action refers to.
+func (dc *DiskCache) Purge(before time.Time) (PurgeStats, error) {
+	var st PurgeStats
+	keep := map[string]bool{} // outputs of remaining actions
+	err := dc.WalkEntries(func(e *DiskEntry) error {
+		if !e.Time.Before(before) {
+			keep[e.OutputID] = true
+			return nil
+		}
+		if err := dc.DeleteAction(e.ActionID); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		st.Actions++
+		return nil
+	})
+	if err != nil {
+		return st, err
+	}
+	err = dc.walkDir(func(de fs.DirEntry) error {
+		outputID, ok := strings.CutPrefix(de.Name(), "o-")
+		if !ok {
+			return nil
+		}
+		outputID = strings.TrimSuffix(outputID, zstdSuffix)
+		if !validID(outputID) || keep[outputID] {
+			return nil
+		}
+		fi, err := de.Info()
+		if err != nil || !fi.ModTime().Before(before) {
+			return nil
+		}
+		if err := os.Remove(filepath.Join(dc.Dir, de.Name())); err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		st.Outputs++
+		st.Bytes += fi.Size()
+		return nil
+	})
+	return st, err
+}
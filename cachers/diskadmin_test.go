@@ -0,0 +1,122 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// putDisk stores data in dc as the output of the action named name, and
+// returns the action and output IDs.
+func putDisk(t *testing.T, ctx context.Context, dc *DiskCache, name, data string) (actionID, outputID string) {
+	t.Helper()
+	actionID, outputID = testActionID(name), testOutput(data)
+	if _, err := dc.Put(ctx, actionID, outputID, int64(len(data)), strings.NewReader(data)); err != nil {
+		t.Fatalf("Put %s: %v", name, err)
+	}
+	return actionID, outputID
+}
+
+func TestWalkEntries(t *testing.T) {
+	dc := &DiskCache{Dir: t.TempDir()}
+	ctx := ContextWithUploader(context.Background(), "ci")
+	a, aOut := putDisk(t, ctx, dc, "a", "output a")
+	b, bOut := putDisk(t, ctx, dc, "b", "output bb")
+
+	var got []*DiskEntry
+	if err := dc.WalkEntries(func(e *DiskEntry) error {
+		got = append(got, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].ActionID == a && got[j].ActionID != a })
+	if len(got) != 2 {
+		t.Fatalf("WalkEntries returned %d entries; want 2", len(got))
+	}
+	for i, want := range []DiskEntry{{ActionID: a, OutputID: aOut, Size: 8}, {ActionID: b, OutputID: bOut, Size: 9}} {
+		e := got[i]
+		if e.ActionID != want.ActionID || e.OutputID != want.OutputID || e.Size != want.Size || e.Uploader != "ci" || e.Time.IsZero() {
+			t.Errorf("entry %d = %+v; want %+v uploaded by ci", i, e, want)
+		}
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err := dc.WalkEntries(func(*DiskEntry) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("WalkEntries stopping early = %v after %d calls; want stop after 1", err, n)
+	}
+}
+
+func TestDeleteOutput(t *testing.T) {
+	ctx := context.Background()
+	dc := &DiskCache{Dir: t.TempDir()}
+	const data = "output to delete"
+	actionID, outputID := putDisk(t, ctx, dc, "a", data)
+
+	freed, err := dc.DeleteOutput(outputID)
+	if err != nil || freed != int64(len(data)) {
+		t.Fatalf("DeleteOutput = %d, %v; want %d, nil", freed, err, len(data))
+	}
+	if diskPath, err := dc.OutputPath(ctx, outputID); diskPath != "" || err != nil {
+		t.Errorf("OutputPath after DeleteOutput = %q, %v; want a miss", diskPath, err)
+	}
+	if e, err := dc.Entry(actionID); e == nil || err != nil {
+		t.Errorf("DeleteOutput removed the action too: %+v, %v", e, err)
+	}
+	if _, err := dc.DeleteOutput(outputID); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("second DeleteOutput = %v; want fs.ErrNotExist", err)
+	}
+	if _, err := dc.DeleteOutput("not-hex"); err == nil {
+		t.Errorf("DeleteOutput of an invalid ID succeeded")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	ctx := context.Background()
+	dc := &DiskCache{Dir: t.TempDir()}
+	const shared, orphan = "shared output", "orphaned output"
+	oldShared, sharedOut := putDisk(t, ctx, dc, "old shared", shared)
+	oldOrphan, orphanOut := putDisk(t, ctx, dc, "old orphan", orphan)
+	time.Sleep(10 * time.Millisecond)
+	cutoff := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	recent, _ := putDisk(t, ctx, dc, "recent", shared)
+
+	// Outputs are purged by when they were last written, which the
+	// recent action did for the shared one; make both look old.
+	old := cutoff.Add(-time.Hour)
+	for _, id := range []string{sharedOut, orphanOut} {
+		if err := os.Chtimes(dc.OutputFilename(id), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	st, err := dc.Purge(cutoff)
+	if err != nil {
+		t.Fatalf("Purge: %v", err)
+	}
+	if want := (PurgeStats{Actions: 2, Outputs: 1, Bytes: int64(len(orphan))}); st != want {
+		t.Errorf("Purge = %+v; want %+v", st, want)
+	}
+	for _, id := range []string{oldShared, oldOrphan} {
+		if e, err := dc.Entry(id); e != nil || err != nil {
+			t.Errorf("old action still present after Purge: %+v, %v", e, err)
+		}
+	}
+	if gotOutput, _, err := dc.Get(ctx, recent); err != nil || gotOutput != sharedOut {
+		t.Errorf("Get of the recent action after Purge = %q, %v; want %q", gotOutput, err, sharedOut)
+	}
+	if diskPath, err := dc.OutputPath(ctx, orphanOut); diskPath != "" || err != nil {
+		t.Errorf("orphaned output survived Purge: %q, %v", diskPath, err)
+	}
+}
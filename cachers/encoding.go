@@ -0,0 +1,133 @@
+package cachers
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content encodings that HTTPRemote and the cacher server can negotiate.
+const (
+	EncodingGzip = "gzip"
+	EncodingZstd = "zstd"
+)
+
+// SizeHeader is the HTTP header carrying the uncompressed size of an output
+// whose body is sent with a Content-Encoding, as the Content-Length is then
+// either the compressed size or absent.
+const SizeHeader = "Go-Cache-Size"
+
+// zstdSuffix is the suffix of outputs stored zstd-compressed on disk.
+const zstdSuffix = ".zst"
+
+// ValidEncoding reports whether enc is a supported content encoding.
+func ValidEncoding(enc string) bool {
+	return enc == EncodingGzip || enc == EncodingZstd
+}
+
+// NewEncoder returns a WriteCloser that compresses to w with the given
+// content encoding. If size is non-negative, it's recorded in the stream
+// where the encoding supports it. Close flushes the stream but doesn't
+// close w.
+func NewEncoder(w io.Writer, enc string, size int64) (io.WriteCloser, error) {
+	switch enc {
+	case EncodingGzip:
+		return gzip.NewWriter(w), nil
+	case EncodingZstd:
+		zw, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			zw.Reset(w)
+		} else {
+			zw.ResetContentSize(w, size)
+		}
+		return zw, nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", enc)
+}
+
+// NewDecoder returns a ReadCloser that decompresses r, which is in the
+// given content encoding. Closing it doesn't close r.
+func NewDecoder(r io.Reader, enc string) (io.ReadCloser, error) {
+	switch enc {
+	case EncodingGzip:
+		return gzip.NewReader(r)
+	case EncodingZstd:
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", enc)
+}
+
+// AcceptsEncoding reports whether the Accept-Encoding header value ae
+// includes enc with a non-zero quality.
+func AcceptsEncoding(ae, enc string) bool {
+	for _, v := range strings.Split(ae, ",") {
+		name, params, _ := strings.Cut(v, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), enc) {
+			continue
+		}
+		for _, p := range strings.Split(params, ";") {
+			if qs, ok := strings.CutPrefix(strings.TrimSpace(p), "q="); ok {
+				q, err := strconv.ParseFloat(qs, 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// StatOutput returns the uncompressed size of the output file at diskPath,
+// as returned by DiskCache, and the content encoding it's stored in, which
+// is empty if it's stored uncompressed.
+func StatOutput(diskPath string) (size int64, encoding string, err error) {
+	if !strings.HasSuffix(diskPath, zstdSuffix) {
+		fi, err := os.Stat(diskPath)
+		if err != nil {
+			return 0, "", err
+		}
+		return fi.Size(), "", nil
+	}
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	hdr := make([]byte, zstd.HeaderMaxSize)
+	n, err := io.ReadFull(f, hdr)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return 0, "", err
+	}
+	var h zstd.Header
+	if err := h.Decode(hdr[:n]); err != nil {
+		return 0, "", fmt.Errorf("%s: %w", diskPath, err)
+	}
+	if h.HasFCS {
+		return int64(h.FrameContentSize), EncodingZstd, nil
+	}
+	// The encoder leaves out the size of small outputs; count them.
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, "", err
+	}
+	zr, err := NewDecoder(f, EncodingZstd)
+	if err != nil {
+		return 0, "", err
+	}
+	defer zr.Close()
+	size, err = io.Copy(io.Discard, zr)
+	if err != nil {
+		return 0, "", fmt.Errorf("%s: %w", diskPath, err)
+	}
+	return size, EncodingZstd, nil
+}
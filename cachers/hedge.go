@@ -0,0 +1,145 @@
+package cachers
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// latencySamples is how many recent response times HTTPRemote keeps
+	// to pick its hedging delay from.
+	latencySamples = 200
+
+	// minLatencySamples is how many response times are needed before the
+	// hedging delay adapts to them. Until then, defaultHedgeDelay is used.
+	minLatencySamples = 20
+	defaultHedgeDelay = 100 * time.Millisecond
+)
+
+// latencyTracker records recent response times of one kind of request.
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples []time.Duration // ring buffer; guarded by mu
+	next    int             // where the next sample goes; guarded by mu
+}
+
+func (lt *latencyTracker) add(d time.Duration) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if len(lt.samples) < latencySamples {
+		lt.samples = append(lt.samples, d)
+		return
+	}
+	lt.samples[lt.next] = d
+	lt.next = (lt.next + 1) % latencySamples
+}
+
+// p95 returns the 95th percentile of the recorded response times, or
+// false if there aren't enough of them yet.
+func (lt *latencyTracker) p95() (time.Duration, bool) {
+	lt.mu.Lock()
+	if len(lt.samples) < minLatencySamples {
+		lt.mu.Unlock()
+		return 0, false
+	}
+	s := append([]time.Duration(nil), lt.samples...)
+	lt.mu.Unlock()
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return s[len(s)*95/100], true
+}
+
+// hedgeDelay returns how long to wait for a response before hedging.
+func (r *HTTPRemote) hedgeDelay(lt *latencyTracker) time.Duration {
+	d, ok := lt.p95()
+	if !ok {
+		d = defaultHedgeDelay
+	}
+	if d < r.HedgeMinDelay {
+		d = r.HedgeMinDelay
+	}
+	return d
+}
+
+// doHedged sends the request made by newReq, and, if Hedge is set and no
+// response arrives within the hedging delay, a second one like it. It
+// returns the first response and cancels the other request. lt records
+// the response times of this kind of request.
+func (r *HTTPRemote) doHedged(ctx context.Context, lt *latencyTracker, newReq func(context.Context) (*http.Request, error)) (*http.Response, error) {
+	if !r.Hedge {
+		req, err := newReq(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return r.do(req)
+	}
+
+	type result struct {
+		res *http.Response
+		err error
+		i   int // 0 for the first request, 1 for the hedge
+	}
+	results := make(chan result, 2)
+	var cancels [2]context.CancelFunc
+	start := func(i int) error {
+		rctx, cancel := context.WithCancel(ctx)
+		req, err := newReq(rctx)
+		if err != nil {
+			cancel()
+			return err
+		}
+		cancels[i] = cancel
+		go func() {
+			t0 := time.Now()
+			res, err := r.do(req)
+			// A request cancelled for losing took at least this long, and
+			// leaving it out would skew the percentile low.
+			if err == nil || rctx.Err() != nil && ctx.Err() == nil {
+				lt.add(time.Since(t0))
+			}
+			results <- result{res, err, i}
+		}()
+		return nil
+	}
+
+	if err := start(0); err != nil {
+		return nil, err
+	}
+	pending := 1
+	timer := time.NewTimer(r.hedgeDelay(lt))
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if start(1) == nil {
+				r.HedgesSent.Add(1)
+				pending++
+			}
+		case res := <-results:
+			pending--
+			if res.err != nil {
+				cancels[res.i]()
+				if pending > 0 {
+					// Maybe the other one does better.
+					continue
+				}
+				return nil, res.err
+			}
+			if res.i == 1 {
+				r.HedgesWon.Add(1)
+			}
+			if pending > 0 {
+				cancels[1-res.i]()
+				go func() {
+					if lost := <-results; lost.res != nil {
+						lost.res.Body.Close()
+					}
+				}()
+			}
+			res.res.Body = &cancelOnClose{res.res.Body, cancels[res.i]}
+			return res.res, nil
+		}
+	}
+}
@@ -1,40 +1,466 @@
 package cachers
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
 )
 
 type HTTPRemote struct {
-	// BaseURL is the base URL of the cacher server, like "http://localhost:31364".
+	// BaseURL is the base URL of the cacher server, like "http://localhost:31364",
+	// or "unix://" followed by the path of a unix domain socket the server
+	// listens on, like "unix:///run/go-cacher.sock".
 	BaseURL string
 
+	// Namespace optionally specifies the server namespace to use, such as
+	// "main" or "pr". Requests then go to BaseURL + "/ns/<Namespace>/...".
+	// Empty means the server's default namespace.
+	Namespace string
+
 	// HTTPClient optionally specifies the http.Client to use.
-	// If nil, http.DefaultClient is used.
+	// If nil, http.DefaultClient is used, unless client certificates are
+	// configured.
 	HTTPClient *http.Client
 
 	// Verbose optionally specifies whether to log verbose messages.
 	Verbose bool
+
+	// BearerToken optionally specifies a token to send in the
+	// Authorization header of every request.
+	BearerToken string
+
+	// Username and Password optionally specify HTTP basic auth credentials.
+	// They're ignored if BearerToken is set.
+	Username string
+	Password string
+
+	// ClientCertFile and ClientKeyFile optionally specify the PEM files of a
+	// TLS client certificate to present to the server. They're ignored if
+	// HTTPClient is set.
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// PreferHTTP2 optionally specifies that HTTP/2 is used, so concurrent
+	// requests share a few connections. For https URLs it's negotiated;
+	// for http and unix URLs the server must accept cleartext HTTP/2
+	// (go-cacher-server -h2c). Such cleartext connections use no TLS and
+	// can't go through a proxy, and requests share one connection, so
+	// TLSHandshakeTimeout and MaxIdleConnsPerHost don't apply to them and
+	// Proxy must be empty or "direct". It's ignored if HTTPClient is set.
+	PreferHTTP2 bool
+
+	// DialTimeout, TLSHandshakeTimeout and ResponseHeaderTimeout optionally
+	// bound how long connecting to the server, the TLS handshake, and
+	// waiting for a response's headers after sending a request may take.
+	// Requests exceeding them fail with a *TimeoutError. Zero means 30s,
+	// 10s and no limit respectively. The first two are ignored if
+	// HTTPClient is set.
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+
+	// MaxIdleConnsPerHost optionally specifies how many idle connections
+	// to the server are kept for reuse. Parallel requests beyond it have
+	// to open new connections. If zero, net/http's default of 2 is used.
+	// It's ignored if HTTPClient is set.
+	MaxIdleConnsPerHost int
+
+	// Proxy optionally specifies the http or https URL of a proxy to reach
+	// the server through, or "direct" to use none. If empty, the proxy comes
+	// from the environment ($HTTPS_PROXY, $NO_PROXY, etc.). It's ignored
+	// if HTTPClient is set, and for unix sockets.
+	Proxy string
+
+	// Headers optionally specifies headers to send with every request.
+	Headers http.Header
+
+	// CAFile optionally specifies a PEM bundle of CA certificates to verify
+	// the server's certificate with, instead of the system's. It's ignored
+	// if HTTPClient is set.
+	CAFile string
+
+	// BatchWindow optionally enables batching of GetAction calls: lookups
+	// that arrive within this long of each other are sent to the server as
+	// a single /actions:batchGet request. Zero disables batching.
+	BatchWindow time.Duration
+
+	// MaxBatchSize optionally specifies the most lookups in a batch. A full
+	// batch is sent without waiting for BatchWindow. If zero, 100 is used.
+	// It's capped at MaxBatchGetActions, the most the server accepts.
+	MaxBatchSize int
+
+	batcher actionBatcher
+
+	// Compression optionally specifies a content encoding, EncodingGzip or
+	// EncodingZstd, to use for uploads and to accept for downloads.
+	// Empty means to send outputs uncompressed.
+	Compression string
+
+	// Hedge optionally enables hedged requests for GetOutput and unbatched
+	// GetAction calls: if a response hasn't started arriving within the
+	// 95th percentile of recent response times, a duplicate request is sent
+	// and whichever responds first is used. The other one is cancelled.
+	// The duplicate goes to the same BaseURL, so it helps with a slow
+	// request or connection, not a slow server; a ShardedUpstream doesn't
+	// hedge across its replicas.
+	Hedge bool
+
+	// HedgeMinDelay optionally specifies the least time to wait before
+	// sending a duplicate request.
+	HedgeMinDelay time.Duration
+
+	// HedgesSent counts the duplicate requests sent by Hedge, and HedgesWon
+	// those that responded first.
+	HedgesSent atomic.Int64
+	HedgesWon  atomic.Int64
+
+	actionLatency latencyTracker
+	outputLatency latencyTracker
+
+	clientOnce sync.Once
+	client     *http.Client
+	clientErr  error
+
+	// backoffUntil is when, in Unix nanoseconds, the server last asked us
+	// to resume sending each class of requests with a 429 response's
+	// Retry-After.
+	backoffUntil [numRequestClasses]atomic.Int64
+}
+
+// Classes of requests, which go-cacher-server rate limits separately, so
+// that being told to slow down uploads doesn't hold back lookups.
+const (
+	readRequests  = iota // GETs, HEADs and batch lookups
+	writeRequests        // PUTs
+	numRequestClasses
+)
+
+func requestClass(req *http.Request) int {
+	if req.Method == "PUT" {
+		return writeRequests
+	}
+	return readRequests
 }
 
 var _ Upstream = (*HTTPRemote)(nil)
 
-func (r *HTTPRemote) httpClient() *http.Client {
+// minCompressSize is the size below which HTTPRemote doesn't bother
+// compressing uploads.
+const minCompressSize = 512
+
+// StatusError is the error returned by HTTPRemote when the server replies
+// with an unexpected HTTP status.
+type StatusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Status     string
+	Body       string // the start of the response body, if any
+
+	// RetryAfter is how long the server asked the client to wait before
+	// retrying, from a Retry-After header. It's zero if there's none.
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("unexpected %s %s status %v", e.Method, e.Path, e.Status)
+	}
+	return fmt.Sprintf("unexpected %s %s status %v: %s", e.Method, e.Path, e.Status, e.Body)
+}
+
+// Temporary reports whether the request might succeed if retried.
+func (e *StatusError) Temporary() bool {
+	switch e.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return e.StatusCode >= 500
+}
+
+// newStatusError returns a *StatusError for res. It reads, but doesn't
+// close, res.Body.
+func newStatusError(res *http.Response) error {
+	all, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
+	return &StatusError{
+		Method:     res.Request.Method,
+		Path:       res.Request.URL.Path,
+		StatusCode: res.StatusCode,
+		Status:     res.Status,
+		Body:       string(bytes.TrimSpace(all)),
+		RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+func (r *HTTPRemote) httpClient() (*http.Client, error) {
 	if r.HTTPClient != nil {
-		return r.HTTPClient
+		return r.HTTPClient, nil
+	}
+	if !r.needsOwnClient() {
+		return http.DefaultClient, nil
 	}
-	return http.DefaultClient
+	r.clientOnce.Do(func() {
+		r.client, r.clientErr = r.newClient()
+	})
+	return r.client, r.clientErr
 }
 
-func (r *HTTPRemote) GetAction(ctx context.Context, actionID string) (*ActionValue, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", r.BaseURL+"/action/"+actionID, nil)
+// needsOwnClient reports whether r's configuration needs an http.Client
+// other than http.DefaultClient.
+func (r *HTTPRemote) needsOwnClient() bool {
+	_, isUnix := r.unixSocket()
+	return isUnix || r.ClientCertFile != "" || r.CAFile != "" || r.PreferHTTP2 ||
+		r.DialTimeout > 0 || r.TLSHandshakeTimeout > 0 ||
+		r.MaxIdleConnsPerHost > 0 || r.Proxy != ""
+}
+
+// unixSocket returns the socket path of a "unix://" BaseURL.
+func (r *HTTPRemote) unixSocket() (path string, ok bool) {
+	return strings.CutPrefix(r.BaseURL, "unix://")
+}
+
+// baseURL returns the URL that request paths are appended to.
+func (r *HTTPRemote) baseURL() string {
+	if _, ok := r.unixSocket(); ok {
+		// The host is only for the Host header; the transport dials the
+		// socket.
+		return "http://unix"
+	}
+	return r.BaseURL
+}
+
+// Defaults for HTTPRemote's DialTimeout and TLSHandshakeTimeout, which are
+// those of http.DefaultTransport.
+const (
+	defaultDialTimeout         = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+)
+
+func (r *HTTPRemote) dialTimeout() time.Duration {
+	if r.DialTimeout > 0 {
+		return r.DialTimeout
+	}
+	return defaultDialTimeout
+}
+
+func (r *HTTPRemote) tlsHandshakeTimeout() time.Duration {
+	if r.TLSHandshakeTimeout > 0 {
+		return r.TLSHandshakeTimeout
+	}
+	return defaultTLSHandshakeTimeout
+}
+
+func (r *HTTPRemote) newClient() (*http.Client, error) {
+	var tlsConfig *tls.Config
+	if r.ClientCertFile != "" || r.CAFile != "" {
+		tlsConfig = &tls.Config{}
+	}
+	if r.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(r.ClientCertFile, r.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if r.CAFile != "" {
+		pem, err := os.ReadFile(r.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", r.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	dialer := &net.Dialer{Timeout: r.dialTimeout(), KeepAlive: 30 * time.Second}
+	dial := dialer.DialContext
+	socket, isUnix := r.unixSocket()
+	if isUnix {
+		dial = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+	}
+	if r.PreferHTTP2 && (isUnix || strings.HasPrefix(r.BaseURL, "http://")) {
+		// Cleartext HTTP/2 with prior knowledge (h2c).
+		if r.Proxy != "" && r.Proxy != "direct" {
+			return nil, errors.New("cleartext HTTP/2 can't go through a proxy")
+		}
+		return &http.Client{Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				return dial(ctx, network, addr)
+			},
+		}}, nil
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.DialContext = dial
+	tr.ForceAttemptHTTP2 = true
+	tr.TLSHandshakeTimeout = r.tlsHandshakeTimeout()
+	if r.MaxIdleConnsPerHost > 0 {
+		tr.MaxIdleConnsPerHost = r.MaxIdleConnsPerHost
+		if tr.MaxIdleConns < r.MaxIdleConnsPerHost {
+			tr.MaxIdleConns = r.MaxIdleConnsPerHost
+		}
+	}
+	switch {
+	case isUnix || r.Proxy == "direct":
+		tr.Proxy = nil
+	case r.Proxy != "":
+		u, err := url.Parse(r.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("bad proxy URL: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return nil, fmt.Errorf("bad proxy URL %q: want http://host:port or https://host:port", r.Proxy)
+		}
+		tr.Proxy = http.ProxyURL(u)
+	}
+	if tlsConfig != nil {
+		tr.TLSClientConfig = tlsConfig
+	}
+	return &http.Client{Transport: tr}, nil
+}
+
+// newRequest returns a request for the given path on the server, with
+// credentials attached.
+func (r *HTTPRemote) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	if r.Namespace != "" {
+		path = "/ns/" + url.PathEscape(r.Namespace) + path
+	}
+	req, err := http.NewRequestWithContext(ctx, method, r.baseURL()+path, body)
 	if err != nil {
 		return nil, err
 	}
-	res, err := r.httpClient().Do(req)
+	for k, vv := range r.Headers {
+		for _, v := range vv {
+			req.Header.Add(k, v)
+		}
+	}
+	if r.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+r.BearerToken)
+	} else if r.Username != "" {
+		req.SetBasicAuth(r.Username, r.Password)
+	}
+	return req, nil
+}
+
+// defaultRateLimitBackoff is how long HTTPRemote stops sending requests
+// after a 429 response without a Retry-After header.
+const defaultRateLimitBackoff = time.Second
+
+func (r *HTTPRemote) do(req *http.Request) (*http.Response, error) {
+	hc, err := r.httpClient()
+	if err != nil {
+		return nil, err
+	}
+	// While rate limited, fail without bothering the server, so callers
+	// fall back to building locally or retry later.
+	backoffUntil := &r.backoffUntil[requestClass(req)]
+	if wait := time.Until(time.Unix(0, backoffUntil.Load())); wait > 0 {
+		return nil, &StatusError{
+			Method:     req.Method,
+			Path:       req.URL.Path,
+			StatusCode: http.StatusTooManyRequests,
+			Status:     "429 Too Many Requests (backing off)",
+			RetryAfter: wait,
+		}
+	}
+	res, err := r.send(hc, req)
+	if err == nil && res.StatusCode == http.StatusTooManyRequests {
+		wait := parseRetryAfter(res.Header.Get("Retry-After"), time.Now())
+		if wait <= 0 {
+			wait = defaultRateLimitBackoff
+		}
+		backoffUntil.Store(time.Now().Add(wait).UnixNano())
+		if r.Verbose {
+			log.Printf("%s %s: rate limited; backing off for %v", req.Method, req.URL.Path, wait)
+		}
+	}
+	return res, err
+}
+
+// parseRetryAfter parses a Retry-After header value, which is either a
+// number of seconds or an HTTP date, relative to now. It returns zero if v
+// is empty or invalid.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// LoadSecret returns the value of the environment variable env if it's
+// set, and otherwise the contents of file, with surrounding whitespace
+// removed. If neither is set, it returns the empty string.
+//
+// It's meant for loading HTTPRemote credentials without putting them on
+// a command line, where other users can see them.
+func LoadSecret(env, file string) (string, error) {
+	if v := os.Getenv(env); v != "" {
+		return v, nil
+	}
+	if file == "" {
+		return "", nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// LoadBasicAuth loads "user:password" credentials with LoadSecret and
+// splits them. If neither env nor file is set, it returns empty strings.
+func LoadBasicAuth(env, file string) (user, password string, err error) {
+	s, err := LoadSecret(env, file)
+	if err != nil || s == "" {
+		return "", "", err
+	}
+	user, password, ok := strings.Cut(s, ":")
+	if !ok {
+		return "", "", errors.New("basic auth credentials must be of the form user:password")
+	}
+	return user, password, nil
+}
+
+func (r *HTTPRemote) GetAction(ctx context.Context, actionID string) (*ActionValue, error) {
+	if r.BatchWindow > 0 {
+		return r.getActionBatched(ctx, actionID)
+	}
+	return r.getActionSingle(ctx, actionID)
+}
+
+func (r *HTTPRemote) getActionSingle(ctx context.Context, actionID string) (*ActionValue, error) {
+	res, err := r.doHedged(ctx, &r.actionLatency, func(ctx context.Context) (*http.Request, error) {
+		return r.newRequest(ctx, "GET", "/action/"+actionID, nil)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -43,7 +469,7 @@ func (r *HTTPRemote) GetAction(ctx context.Context, actionID string) (*ActionVal
 		return nil, errNotFound
 	}
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected GET /action/%s status %v", actionID, res.Status)
+		return nil, newStatusError(res)
 	}
 	var av ActionValue
 	if err := json.NewDecoder(res.Body).Decode(&av); err != nil {
@@ -52,26 +478,100 @@ func (r *HTTPRemote) GetAction(ctx context.Context, actionID string) (*ActionVal
 	return &av, nil
 }
 
-// GetOutput implements Upstream.
+// GetOutput implements Upstream. If the connection fails partway through
+// the body, the download resumes with a Range request from where it
+// stopped, within the same body; see resumable.
 func (r *HTTPRemote) GetOutput(ctx context.Context, outputID string) (body io.ReadCloser, err error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", r.BaseURL+"/output/"+outputID, nil)
-	if err != nil {
-		return nil, err
-	}
-	res, err := r.httpClient().Do(req)
+	res, err := r.doHedged(ctx, &r.outputLatency, func(ctx context.Context) (*http.Request, error) {
+		return r.outputRequest(ctx, outputID)
+	})
 	if err != nil {
 		return nil, err
 	}
 	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
 		return nil, errNotFound
 	}
 	if res.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected GET /output/%s status %v", outputID, res.Status)
+		defer res.Body.Close()
+		return nil, newStatusError(res)
+	}
+	enc := res.Header.Get("Content-Encoding")
+	if enc == "" && !res.Uncompressed {
+		if res.ContentLength == -1 {
+			res.Body.Close()
+			return nil, fmt.Errorf("no Content-Length from server")
+		}
+		return r.resumable(ctx, outputID, res), nil // let caller to close body
+	}
+
+	// The body is compressed, so Content-Length, if any, isn't the size of
+	// the output. The server sends that separately.
+	size, err := strconv.ParseInt(res.Header.Get(SizeHeader), 10, 64)
+	if err != nil {
+		res.Body.Close()
+		return nil, fmt.Errorf("no valid %s from server for %s response", SizeHeader, enc)
+	}
+	if res.Uncompressed {
+		// The transport already decompressed it.
+		return &sizeCheckReader{rc: res.Body, want: size}, nil
+	}
+	rb := r.resumable(ctx, outputID, res)
+	dec, err := NewDecoder(rb, enc)
+	if err != nil {
+		rb.Close()
+		return nil, err
+	}
+	return &sizeCheckReader{rc: rb, r: dec, dec: dec, want: size}, nil
+}
+
+// outputRequest returns a request for an output.
+func (r *HTTPRemote) outputRequest(ctx context.Context, outputID string) (*http.Request, error) {
+	req, err := r.newRequest(ctx, "GET", "/output/"+outputID, nil)
+	if err != nil {
+		return nil, err
 	}
-	if res.ContentLength == -1 {
-		return nil, fmt.Errorf("no Content-Length from server")
+	if r.Compression != "" {
+		req.Header.Set("Accept-Encoding", r.Compression)
+	} else {
+		// Otherwise the transport asks for gzip and decompresses the
+		// response itself, which leaves it unable to be resumed.
+		req.Header.Set("Accept-Encoding", "identity")
 	}
-	return res.Body, nil // let caller to close body
+	return req, nil
+}
+
+// sizeCheckReader reads a decompressed output body, failing at EOF if it
+// wasn't the expected size.
+type sizeCheckReader struct {
+	rc   io.ReadCloser // the response body
+	r    io.Reader     // what to read from; rc if nil
+	dec  io.Closer     // optional decoder to close along with rc
+	want int64
+	got  int64
+}
+
+func (s *sizeCheckReader) Read(p []byte) (int, error) {
+	r := s.r
+	if r == nil {
+		r = s.rc
+	}
+	n, err := r.Read(p)
+	s.got += int64(n)
+	if s.got > s.want {
+		return n, fmt.Errorf("decompressed output longer than %d bytes", s.want)
+	}
+	if err == io.EOF && s.got != s.want {
+		return n, fmt.Errorf("decompressed output is %d bytes, expected %d", s.got, s.want)
+	}
+	return n, err
+}
+
+func (s *sizeCheckReader) Close() error {
+	if s.dec != nil {
+		s.dec.Close()
+	}
+	return s.rc.Close()
 }
 
 func (r *HTTPRemote) Put(
@@ -81,19 +581,93 @@ func (r *HTTPRemote) Put(
 	size int64,
 	body io.Reader,
 ) error {
-	req, err := http.NewRequestWithContext(ctx, "PUT", r.BaseURL+"/"+actionID+"/"+outputID, body)
+	compress := r.Compression != "" && size >= minCompressSize
+	if compress {
+		src := body
+		pr, pw := io.Pipe()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			zw, err := NewEncoder(pw, r.Compression, size)
+			if err == nil {
+				_, err = io.Copy(zw, src)
+				if cerr := zw.Close(); err == nil {
+					err = cerr
+				}
+			}
+			pw.CloseWithError(err)
+		}()
+		defer func() {
+			// Unblock the encoder if the request failed early, and wait for
+			// it to stop reading body, which a retry may rewind.
+			pr.Close()
+			<-done
+		}()
+		body = pr
+	}
+	req, err := r.newRequest(ctx, "PUT", "/"+actionID+"/"+outputID, body)
 	if err != nil {
 		return err
 	}
 	req.ContentLength = size
-	res, err := r.httpClient().Do(req)
+	if compress {
+		req.ContentLength = -1 // unknown until compressed
+		req.Header.Set("Content-Encoding", r.Compression)
+		req.Header.Set(SizeHeader, strconv.FormatInt(size, 10))
+	}
+	res, err := r.do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		return newStatusError(res)
+	}
+	return nil
+}
+
+// HasOutput implements Upstream.
+func (r *HTTPRemote) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	req, err := r.newRequest(ctx, "HEAD", "/output/"+outputID, nil)
+	if err != nil {
+		return false, err
+	}
+	res, err := r.do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, newStatusError(res)
+}
+
+// PutAction implements Upstream.
+func (r *HTTPRemote) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	avj, err := json.Marshal(&ActionValue{OutputID: outputID, Size: size})
+	if err != nil {
+		return err
+	}
+	req, err := r.newRequest(ctx, "PUT", "/action/"+actionID, bytes.NewReader(avj))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := r.do(req)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		// The server no longer has the output.
+		return errNotFound
+	}
 	if res.StatusCode != http.StatusNoContent {
-		all, _ := io.ReadAll(io.LimitReader(res.Body, 4<<10))
-		return fmt.Errorf("unexpected PUT /%s/%s status %v: %s", actionID, outputID, res.Status, all)
+		return newStatusError(res)
 	}
 	return nil
-}
\ No newline at end of file
+}
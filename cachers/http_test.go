@@ -0,0 +1,129 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimitBackoffPerClass(t *testing.T) {
+	var puts, gets atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			puts.Add(1)
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		gets.Add(1)
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer srv.Close()
+	r := &HTTPRemote{BaseURL: srv.URL}
+	ctx := context.Background()
+
+	put := func() error {
+		return r.Put(ctx, testActionID("a"), testOutput("x"), 1, bytes.NewReader([]byte("x")))
+	}
+	for i := 0; i < 2; i++ {
+		var se *StatusError
+		if err := put(); !errors.As(err, &se) || se.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("Put %d = %v; want a 429 StatusError", i, err)
+		}
+	}
+	if n := puts.Load(); n != 1 {
+		t.Errorf("server got %d PUTs; want 1, then backing off", n)
+	}
+
+	if _, err := r.GetAction(ctx, testActionID("a")); !errors.Is(err, errNotFound) {
+		t.Errorf("GetAction while PUTs are backing off = %v; want not found", err)
+	}
+	if has, err := r.HasOutput(ctx, testOutput("x")); has || err != nil {
+		t.Errorf("HasOutput while PUTs are backing off = %v, %v; want false, nil", has, err)
+	}
+	if n := gets.Load(); n != 2 {
+		t.Errorf("server got %d lookups; want 2", n)
+	}
+}
+
+func TestHedgedGetOutput(t *testing.T) {
+	const data = "hedged output"
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			// The first request stalls until it's cancelled.
+			<-r.Context().Done()
+			return
+		}
+		io.WriteString(w, data)
+	}))
+	defer srv.Close()
+	r := &HTTPRemote{BaseURL: srv.URL, Hedge: true, HedgeMinDelay: 10 * time.Millisecond}
+
+	body, err := r.GetOutput(context.Background(), testOutput(data))
+	if err != nil {
+		t.Fatalf("GetOutput: %v", err)
+	}
+	got, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(got) != data {
+		t.Errorf("GetOutput body = %q, %v; want %q", got, err, data)
+	}
+	if sent, won := r.HedgesSent.Load(), r.HedgesWon.Load(); sent != 1 || won != 1 {
+		t.Errorf("HedgesSent, HedgesWon = %d, %d; want 1, 1", sent, won)
+	}
+}
+
+func TestHedgeNotSentForFastResponses(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "x")
+	}))
+	defer srv.Close()
+	r := &HTTPRemote{BaseURL: srv.URL, Hedge: true, HedgeMinDelay: time.Second}
+	for i := 0; i < 5; i++ {
+		body, err := r.GetOutput(context.Background(), testOutput("x"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, body)
+		body.Close()
+	}
+	if sent := r.HedgesSent.Load(); sent != 0 {
+		t.Errorf("HedgesSent = %d; want 0", sent)
+	}
+}
+
+func TestLoadBasicAuth(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "creds")
+	if err := os.WriteFile(file, []byte("fileuser:file:pass\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	const env = "GOCACHER_TEST_BASIC_AUTH"
+	tests := []struct {
+		env, file          string
+		wantUser, wantPass string
+		wantErr            bool
+	}{
+		{"", "", "", "", false},
+		{"", file, "fileuser", "file:pass", false},
+		{"envuser:envpass", file, "envuser", "envpass", false},
+		{"no-colon", "", "", "", true},
+		{"", filepath.Join(t.TempDir(), "missing"), "", "", true},
+	}
+	for _, tt := range tests {
+		t.Setenv(env, tt.env)
+		user, pass, err := LoadBasicAuth(env, tt.file)
+		if user != tt.wantUser || pass != tt.wantPass || (err != nil) != tt.wantErr {
+			t.Errorf("LoadBasicAuth with $%s=%q, file %q = %q, %q, %v; want %q, %q, error %v",
+				env, tt.env, tt.file, user, pass, err, tt.wantUser, tt.wantPass, tt.wantErr)
+		}
+	}
+}
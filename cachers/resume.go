@@ -0,0 +1,113 @@
+package cachers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// maxResumes is how many times HTTPRemote resumes an interrupted output
+// download before failing it.
+const maxResumes = 3
+
+// resumable returns res's body, made to continue with a Range request if
+// the connection fails partway through, instead of failing the download.
+// Resuming happens within the stream, so the caller reads one unbroken
+// body; a download that fails anyway isn't kept to resume later, as the
+// caller discards its partial temp file. The transfer resumes in whatever
+// content encoding it started in, so a body the transport decompressed
+// itself can't be resumed; outputRequest asks for identity to avoid that.
+func (r *HTTPRemote) resumable(ctx context.Context, outputID string, res *http.Response) io.ReadCloser {
+	etag := res.Header.Get("ETag")
+	if etag == "" || res.Uncompressed {
+		return res.Body
+	}
+	return &resumingBody{
+		r:        r,
+		ctx:      ctx,
+		outputID: outputID,
+		etag:     etag,
+		enc:      res.Header.Get("Content-Encoding"),
+		body:     res.Body,
+	}
+}
+
+// resumingBody is an output response body that picks up where it left
+// off after a read error.
+type resumingBody struct {
+	r        *HTTPRemote
+	ctx      context.Context
+	outputID string
+	etag     string // of the first response, to resume the same bytes
+	enc      string // Content-Encoding of the first response
+
+	body    io.ReadCloser
+	off     int64 // bytes of the body read so far
+	resumes int
+}
+
+func (b *resumingBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.off += int64(n)
+	if err == nil || err == io.EOF || b.resumes >= maxResumes || b.ctx.Err() != nil {
+		return n, err
+	}
+	b.resumes++
+	if b.r.Verbose {
+		log.Printf("GetOutput(%s): resuming at byte %d after: %v", b.outputID, b.off, err)
+	}
+	if rerr := b.resume(); rerr != nil {
+		if b.r.Verbose {
+			log.Printf("GetOutput(%s): resume failed: %v", b.outputID, rerr)
+		}
+		return n, err
+	}
+	if n > 0 {
+		return n, nil
+	}
+	return b.Read(p)
+}
+
+// resume replaces b.body with the rest of the output from b.off.
+func (b *resumingBody) resume() error {
+	b.body.Close()
+	req, err := b.r.outputRequest(b.ctx, b.outputID)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.off))
+	req.Header.Set("If-Range", b.etag)
+	res, err := b.r.do(req)
+	if err != nil {
+		return err
+	}
+	if res.Header.Get("ETag") != b.etag || res.Header.Get("Content-Encoding") != b.enc {
+		res.Body.Close()
+		return fmt.Errorf("output changed representation: ETag %s, Content-Encoding %q", res.Header.Get("ETag"), res.Header.Get("Content-Encoding"))
+	}
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		if want := fmt.Sprintf("bytes %d-", b.off); !strings.HasPrefix(res.Header.Get("Content-Range"), want) {
+			res.Body.Close()
+			return fmt.Errorf("unexpected Content-Range %q", res.Header.Get("Content-Range"))
+		}
+	case http.StatusOK:
+		// The server ignored the range, so skip what we already have.
+		if _, err := io.CopyN(io.Discard, res.Body, b.off); err != nil {
+			res.Body.Close()
+			return err
+		}
+	default:
+		defer res.Body.Close()
+		return newStatusError(res)
+	}
+	b.body = res.Body
+	return nil
+}
+
+func (b *resumingBody) Close() error {
+	return b.body.Close()
+}
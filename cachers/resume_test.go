@@ -0,0 +1,58 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetOutputResumes(t *testing.T) {
+	data := strings.Repeat("0123456789", 10000)
+	outputID := testOutput(data)
+	var mu sync.Mutex
+	var ranges, acceptEncodings []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		first := len(ranges) == 0
+		ranges = append(ranges, r.Header.Get("Range"))
+		acceptEncodings = append(acceptEncodings, r.Header.Get("Accept-Encoding"))
+		mu.Unlock()
+		w.Header().Set("ETag", `"`+outputID+`"`)
+		if first {
+			// Send half the output, then drop the connection.
+			w.Header().Set("Content-Length", "100000")
+			io.WriteString(w, data[:len(data)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(data))
+	}))
+	defer srv.Close()
+	r := &HTTPRemote{BaseURL: srv.URL}
+
+	body, err := r.GetOutput(context.Background(), outputID)
+	if err != nil {
+		t.Fatalf("GetOutput: %v", err)
+	}
+	got, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || !bytes.Equal(got, []byte(data)) {
+		t.Fatalf("read %d bytes, %v; want %d bytes of the output", len(got), err, len(data))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(ranges) != 2 || ranges[0] != "" || !strings.HasPrefix(ranges[1], "bytes=") || ranges[1] == "bytes=0-" {
+		t.Errorf("got requests with Range %q; want none, then from where it stopped", ranges)
+	}
+	for _, ae := range acceptEncodings {
+		if ae != "identity" {
+			t.Errorf("request had Accept-Encoding %q; want identity, so it can be resumed", ae)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package cachers
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/url"
+	"time"
+)
+
+// RetryUpstream is an Upstream that retries failed calls to another
+// Upstream with bounded exponential backoff and jitter.
+//
+// Lookups are always retried. Puts are only retried when their body can be
+// replayed, which is the case when it's an io.Seeker such as an *os.File.
+// Failures to connect, dropped connections, timeouts and 5xx, 408 and 429
+// statuses are retried. Other errors, like not-found results, other 4xx
+// statuses and undecodable responses, are only retried if they report
+// Temporary() == true. A StatusError's RetryAfter, as sent with 429
+// responses, extends the backoff.
+type RetryUpstream struct {
+	Upstream Upstream
+
+	// MaxAttempts optionally specifies the maximum number of attempts per
+	// call, including the first. If zero, 4 is used.
+	MaxAttempts int
+
+	// InitialBackoff optionally specifies the delay before the first retry.
+	// It doubles for each subsequent retry. If zero, 100ms is used.
+	InitialBackoff time.Duration
+
+	// MaxBackoff optionally specifies the maximum delay between attempts.
+	// If zero, 5s is used.
+	MaxBackoff time.Duration
+
+	// CallTimeout optionally specifies a deadline for each call, covering
+	// all of its attempts. For GetOutput it only covers getting a response,
+	// not reading the body, and it doesn't apply to Put, so that large
+	// transfers aren't cut off; an HTTPRemote's DialTimeout and
+	// ResponseHeaderTimeout bound those instead. If zero, calls are only
+	// bounded by their context.
+	CallTimeout time.Duration
+
+	// Verbose optionally specifies whether to log retries.
+	Verbose bool
+}
+
+var _ Upstream = (*RetryUpstream)(nil)
+
+func (r *RetryUpstream) maxAttempts() int {
+	if r.MaxAttempts > 0 {
+		return r.MaxAttempts
+	}
+	return 4
+}
+
+// backoff returns how long to wait before retry number n, counting from 1.
+func (r *RetryUpstream) backoff(n int) time.Duration {
+	d, limit := r.InitialBackoff, r.MaxBackoff
+	if d <= 0 {
+		d = 100 * time.Millisecond
+	}
+	if limit <= 0 {
+		limit = 5 * time.Second
+	}
+	for i := 1; i < n && d < limit; i++ {
+		d *= 2
+	}
+	if d > limit {
+		d = limit
+	}
+	// Equal jitter: somewhere in [d/2, d).
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (r *RetryUpstream) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.CallTimeout > 0 {
+		return context.WithTimeout(ctx, r.CallTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// retryable reports whether err might go away if the call is retried.
+// Once ctx is done, nothing is.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, errNotFound) {
+		return false
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Temporary()
+	}
+	var te *TimeoutError
+	if errors.As(err, &te) {
+		return true
+	}
+	var cve *tls.CertificateVerificationError
+	if errors.As(err, &cve) {
+		return false
+	}
+	// Failing to connect, or the connection being reset or closed early,
+	// may well not happen next time, even though net/http doesn't report
+	// those errors as temporary.
+	var oe *net.OpError
+	if errors.As(err, &oe) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	var ue *url.Error
+	if errors.As(err, &ue) && ue.Err == io.EOF {
+		return true // the server closed the connection before responding
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var tmp interface{ Temporary() bool }
+	if errors.As(err, &tmp) {
+		return tmp.Temporary()
+	}
+	// Anything else, like a response that can't be decoded, would most
+	// likely fail the same way again.
+	return false
+}
+
+// do calls f until it succeeds, returns a non-retryable error, runs out of
+// attempts, or ctx is done. The op is only used for logging.
+func (r *RetryUpstream) do(ctx context.Context, op string, f func() error) error {
+	for n := 1; ; n++ {
+		err := f()
+		if err == nil || n >= r.maxAttempts() || !retryable(ctx, err) {
+			return err
+		}
+		wait := r.backoff(n)
+		// Rate-limited servers say how long to wait.
+		var se *StatusError
+		if errors.As(err, &se) && se.RetryAfter > wait {
+			wait = se.RetryAfter
+		}
+		if r.Verbose {
+			log.Printf("retrying %s in %v after attempt %d: %v", op, wait, n, err)
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return fmt.Errorf("%s: %w (last error: %v)", op, ctx.Err(), err)
+		case <-t.C:
+		}
+	}
+}
+
+func (r *RetryUpstream) GetAction(ctx context.Context, actionID string) (av *ActionValue, err error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	err = r.do(ctx, "GetAction "+actionID, func() (err error) {
+		av, err = r.Upstream.GetAction(ctx, actionID)
+		return err
+	})
+	return av, err
+}
+
+func (r *RetryUpstream) GetOutput(ctx context.Context, outputID string) (body io.ReadCloser, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	var timer *time.Timer
+	if r.CallTimeout > 0 {
+		timer = time.AfterFunc(r.CallTimeout, cancel)
+	}
+	err = r.do(ctx, "GetOutput "+outputID, func() (err error) {
+		body, err = r.Upstream.GetOutput(ctx, outputID)
+		return err
+	})
+	if timer != nil && !timer.Stop() {
+		// The deadline passed, maybe just as the response arrived.
+		if err == nil {
+			body.Close()
+		}
+		err = fmt.Errorf("GetOutput %s: no response within %v: %w", outputID, r.CallTimeout, context.DeadlineExceeded)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// The body's reads are only bounded by the caller's context.
+	return &cancelOnClose{body, cancel}, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func (r *RetryUpstream) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	seeker, ok := body.(io.Seeker)
+	if !ok && size > 0 {
+		return r.Upstream.Put(ctx, actionID, outputID, size, body)
+	}
+	var start int64
+	if ok {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			return r.Upstream.Put(ctx, actionID, outputID, size, body)
+		}
+	}
+	first := true
+	return r.do(ctx, "Put "+actionID, func() error {
+		if !first && seeker != nil {
+			if _, err := seeker.Seek(start, io.SeekStart); err != nil {
+				return err
+			}
+		}
+		first = false
+		return r.Upstream.Put(ctx, actionID, outputID, size, body)
+	})
+}
+
+func (r *RetryUpstream) HasOutput(ctx context.Context, outputID string) (has bool, err error) {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	err = r.do(ctx, "HasOutput "+outputID, func() (err error) {
+		has, err = r.Upstream.HasOutput(ctx, outputID)
+		return err
+	})
+	return has, err
+}
+
+func (r *RetryUpstream) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	ctx, cancel := r.withTimeout(ctx)
+	defer cancel()
+	return r.do(ctx, "PutAction "+actionID, func() error {
+		return r.Upstream.PutAction(ctx, actionID, outputID, size)
+	})
+}
@@ -0,0 +1,149 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"not found", errNotFound, false},
+		{"wrapped not found", fmt.Errorf("tier x: %w", errNotFound), false},
+		{"500", &StatusError{StatusCode: 500}, true},
+		{"503", &StatusError{StatusCode: 503}, true},
+		{"429", &StatusError{StatusCode: 429}, true},
+		{"408", &StatusError{StatusCode: 408}, true},
+		{"400", &StatusError{StatusCode: 400}, false},
+		{"403", &StatusError{StatusCode: 403}, false},
+		{"connection refused", &url.Error{Op: "Get", URL: "http://x", Err: refused}, true},
+		{"connection reset", &url.Error{Op: "Get", URL: "http://x", Err: &net.OpError{Op: "read", Err: syscall.ECONNRESET}}, true},
+		{"unexpected EOF", &url.Error{Op: "Get", URL: "http://x", Err: io.ErrUnexpectedEOF}, true},
+		{"body cut short", io.ErrUnexpectedEOF, true},
+		{"timeout", &TimeoutError{Phase: "dial"}, true},
+		{"canceled", context.Canceled, false},
+		{"deadline", context.DeadlineExceeded, false},
+		{"server closed connection", &url.Error{Op: "Get", URL: "http://x", Err: io.EOF}, true},
+		{"bad response", &url.Error{Op: "Get", URL: "http://x", Err: errors.New("malformed HTTP response")}, false},
+		{"decode error", fmt.Errorf("decoding action: %w", errors.New("invalid character")), false},
+		{"other", errors.New("boom"), false},
+	}
+	for _, tt := range tests {
+		if got := retryable(context.Background(), tt.err); got != tt.want {
+			t.Errorf("%s: retryable(%v) = %v; want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if retryable(ctx, &url.Error{Op: "Get", URL: "http://x", Err: refused}) {
+		t.Errorf("retryable with ctx done = true; want false")
+	}
+}
+
+func TestRetryConnectionRefused(t *testing.T) {
+	// Find a port nothing listens on.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	var attempts atomic.Int32
+	up := &countingUpstream{Upstream: &HTTPRemote{BaseURL: "http://" + addr}, n: &attempts}
+	r := &RetryUpstream{Upstream: up, MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	if _, err := r.GetAction(context.Background(), testActionID("a")); err == nil {
+		t.Fatal("GetAction succeeded with no server")
+	}
+	if got := attempts.Load(); got != 3 {
+		t.Errorf("got %d attempts; want 3", got)
+	}
+}
+
+// countingUpstream counts GetAction calls.
+type countingUpstream struct {
+	Upstream
+	n *atomic.Int32
+}
+
+func (c *countingUpstream) GetAction(ctx context.Context, actionID string) (*ActionValue, error) {
+	c.n.Add(1)
+	return c.Upstream.GetAction(ctx, actionID)
+}
+
+func TestRetryGetOutputBodyOutlivesTimeout(t *testing.T) {
+	const data = "slow output"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, data)
+	}))
+	defer srv.Close()
+
+	r := &RetryUpstream{
+		Upstream:    &HTTPRemote{BaseURL: srv.URL},
+		CallTimeout: 50 * time.Millisecond,
+	}
+	body, err := r.GetOutput(context.Background(), testOutput(data))
+	if err != nil {
+		t.Fatalf("GetOutput: %v", err)
+	}
+	defer body.Close()
+	got, err := io.ReadAll(body)
+	if err != nil || string(got) != data {
+		t.Errorf("read %q, %v; want %q", got, err, data)
+	}
+}
+
+func TestRetryGetOutputNoResponse(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	r := &RetryUpstream{
+		Upstream:    &HTTPRemote{BaseURL: srv.URL},
+		CallTimeout: 50 * time.Millisecond,
+	}
+	_, err := r.GetOutput(context.Background(), testOutput("x"))
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "no response") {
+		t.Errorf("GetOutput error = %v; want a deadline error", err)
+	}
+}
+
+func TestRetryPutNotCutOffByCallTimeout(t *testing.T) {
+	mem := newMemUpstream()
+	up := blockingUpstream{mem, make(chan struct{})}
+	r := &RetryUpstream{Upstream: up, CallTimeout: 20 * time.Millisecond}
+	time.AfterFunc(100*time.Millisecond, func() { close(up.release) })
+	const data = "slow upload"
+	if err := r.Put(context.Background(), testActionID("a"), testOutput(data), int64(len(data)), strings.NewReader(data)); err != nil {
+		t.Fatalf("Put taking longer than CallTimeout: %v", err)
+	}
+	if !mem.has(testActionID("a")) {
+		t.Errorf("upstream doesn't have the action")
+	}
+}
@@ -0,0 +1,303 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Shard is one node of a ShardedUpstream.
+type Shard struct {
+	// Name identifies the shard. Keys are assigned to shards by hashing it,
+	// so it must stay the same across processes and restarts, like a
+	// server's base URL.
+	Name string
+
+	Upstream Upstream
+}
+
+// ShardedUpstream is an Upstream that spreads entries over several
+// upstreams, like a set of go-cacher-servers, so that the cache can grow
+// beyond one server without a key-aware load balancer in front of it.
+//
+// Actions are assigned to shards by their action ID and outputs by their
+// output ID, using rendezvous hashing, so adding or removing a shard only
+// moves the keys that belong to it. Each key is stored on Replicas shards.
+// As servers only accept actions whose outputs they have, outputs are also
+// written to the shards of the actions referring to them.
+//
+// A shard that fails is marked down for DownTime, during which its keys go
+// to the next shards in their ranking. Reads of them miss until it's back.
+type ShardedUpstream struct {
+	Shards []Shard
+
+	// Replicas optionally specifies how many shards each key is stored on.
+	// Reads try them in turn until one hits. If zero, 1 is used.
+	Replicas int
+
+	// DownTime optionally specifies how long a failed shard is skipped.
+	// If zero, 30s is used.
+	DownTime time.Duration
+
+	// Verbose optionally specifies whether to log verbose messages.
+	Verbose bool
+
+	mu        sync.Mutex
+	downUntil map[string]time.Time // by shard name; guarded by mu
+}
+
+var _ Upstream = (*ShardedUpstream)(nil)
+
+func (s *ShardedUpstream) replicas() int {
+	if s.Replicas > 0 {
+		return s.Replicas
+	}
+	return 1
+}
+
+func (s *ShardedUpstream) downTime() time.Duration {
+	if s.DownTime > 0 {
+		return s.DownTime
+	}
+	return 30 * time.Second
+}
+
+// shardsFor returns the shards that key belongs on: the Replicas
+// highest-ranked ones for it that aren't down.
+func (s *ShardedUpstream) shardsFor(key string) ([]*Shard, error) {
+	type ranked struct {
+		shard *Shard
+		score uint64
+	}
+	rank := make([]ranked, len(s.Shards))
+	for i := range s.Shards {
+		sh := &s.Shards[i]
+		h := fnv.New64a()
+		io.WriteString(h, sh.Name)
+		h.Write([]byte{0})
+		io.WriteString(h, key)
+		rank[i] = ranked{sh, h.Sum64()}
+	}
+	sort.Slice(rank, func(i, j int) bool { return rank[i].score > rank[j].score })
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var shards []*Shard
+	for _, r := range rank {
+		if now.Before(s.downUntil[r.shard.Name]) {
+			continue
+		}
+		shards = append(shards, r.shard)
+		if len(shards) == s.replicas() {
+			break
+		}
+	}
+	if len(shards) == 0 {
+		return nil, fmt.Errorf("all %d shards are down", len(s.Shards))
+	}
+	return shards, nil
+}
+
+// observe marks sh down if err says it's failing, rather than that the
+// entry is missing or ctx is done.
+func (s *ShardedUpstream) observe(ctx context.Context, sh *Shard, err error) {
+	if err == nil || ctx.Err() != nil || !shardFailed(err) {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.downUntil == nil {
+		s.downUntil = make(map[string]time.Time)
+	}
+	if time.Now().After(s.downUntil[sh.Name]) {
+		log.Printf("shard %s: marking down for %v: %v", sh.Name, s.downTime(), err)
+	}
+	s.downUntil[sh.Name] = time.Now().Add(s.downTime())
+}
+
+// shardFailed reports whether err means the shard itself is failing: it
+// couldn't be reached, or replied with a 5xx or 429 status.
+func shardFailed(err error) bool {
+	if errors.Is(err, errNotFound) || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var se *StatusError
+	if errors.As(err, &se) {
+		return se.Temporary()
+	}
+	return true
+}
+
+func (s *ShardedUpstream) GetAction(ctx context.Context, actionID string) (*ActionValue, error) {
+	shards, err := s.shardsFor(actionID)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, sh := range shards {
+		av, err := sh.Upstream.GetAction(ctx, actionID)
+		if err == nil {
+			return av, nil
+		}
+		s.observe(ctx, sh, err)
+		if IgnoreNotFound(err) != nil && firstErr == nil {
+			firstErr = fmt.Errorf("shard %s: %w", sh.Name, err)
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, errNotFound
+}
+
+func (s *ShardedUpstream) GetOutput(ctx context.Context, outputID string) (io.ReadCloser, error) {
+	shards, err := s.shardsFor(outputID)
+	if err != nil {
+		return nil, err
+	}
+	var firstErr error
+	for _, sh := range shards {
+		body, err := sh.Upstream.GetOutput(ctx, outputID)
+		if err == nil {
+			return body, nil
+		}
+		s.observe(ctx, sh, err)
+		if IgnoreNotFound(err) != nil && firstErr == nil {
+			firstErr = fmt.Errorf("shard %s: %w", sh.Name, err)
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, errNotFound
+}
+
+// Put streams the output, with the action, to the union of the output's
+// and the action's shards in parallel, reading body once. The output's
+// shards record the action too, as there's no way to upload an output on
+// its own, but action lookups never go to them. It fails if any shard
+// does; the failing shards are marked down, so a retry goes elsewhere.
+func (s *ShardedUpstream) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	outputShards, err := s.shardsFor(outputID)
+	if err != nil {
+		return err
+	}
+	actionShards, err := s.shardsFor(actionID)
+	if err != nil {
+		return err
+	}
+	shards := outputShards
+	for _, sh := range actionShards {
+		if !containsShard(shards, sh) {
+			shards = append(shards, sh)
+		}
+	}
+	tiers := make([]Tier, len(shards))
+	for i, sh := range shards {
+		tiers[i] = Tier{Name: sh.Name, Upstream: observedShard{s, sh}}
+	}
+	t := &TieredUpstream{Tiers: tiers, Verbose: s.Verbose}
+	return t.Put(ctx, actionID, outputID, size, body)
+}
+
+func containsShard(shards []*Shard, sh *Shard) bool {
+	for _, s := range shards {
+		if s == sh {
+			return true
+		}
+	}
+	return false
+}
+
+// HasOutput reports whether all of the output's shards have it.
+func (s *ShardedUpstream) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	shards, err := s.shardsFor(outputID)
+	if err != nil {
+		return false, err
+	}
+	for _, sh := range shards {
+		has, err := observedShard{s, sh}.HasOutput(ctx, outputID)
+		if err != nil {
+			return false, fmt.Errorf("shard %s: %w", sh.Name, err)
+		}
+		if !has {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// PutAction records the action on its shards. Those that don't have the
+// output yet get a copy of it from one of the output's shards first.
+func (s *ShardedUpstream) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	shards, err := s.shardsFor(actionID)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, sh := range shards {
+		if err := s.putActionOn(ctx, sh, actionID, outputID, size); err != nil {
+			errs = append(errs, fmt.Errorf("shard %s: %w", sh.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *ShardedUpstream) putActionOn(ctx context.Context, sh *Shard, actionID, outputID string, size int64) error {
+	up := observedShard{s, sh}
+	has, err := up.HasOutput(ctx, outputID)
+	if err != nil {
+		return err
+	}
+	if has {
+		return up.PutAction(ctx, actionID, outputID, size)
+	}
+	if s.Verbose {
+		log.Printf("shard %s: copying output %s for action %s", sh.Name, outputID, actionID)
+	}
+	body, err := s.GetOutput(ctx, outputID)
+	if err != nil {
+		return fmt.Errorf("copying output %s: %w", outputID, err)
+	}
+	defer body.Close()
+	return up.Put(ctx, actionID, outputID, size, body)
+}
+
+// observedShard is a shard's Upstream whose write errors mark it down.
+type observedShard struct {
+	s  *ShardedUpstream
+	sh *Shard
+}
+
+func (o observedShard) GetAction(ctx context.Context, actionID string) (*ActionValue, error) {
+	return o.sh.Upstream.GetAction(ctx, actionID)
+}
+
+func (o observedShard) GetOutput(ctx context.Context, outputID string) (io.ReadCloser, error) {
+	return o.sh.Upstream.GetOutput(ctx, outputID)
+}
+
+func (o observedShard) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	err := o.sh.Upstream.Put(ctx, actionID, outputID, size, body)
+	o.s.observe(ctx, o.sh, err)
+	return err
+}
+
+func (o observedShard) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	has, err := o.sh.Upstream.HasOutput(ctx, outputID)
+	o.s.observe(ctx, o.sh, err)
+	return has, err
+}
+
+func (o observedShard) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	err := o.sh.Upstream.PutAction(ctx, actionID, outputID, size)
+	o.s.observe(ctx, o.sh, err)
+	return err
+}
@@ -0,0 +1,156 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+)
+
+// newTestShards returns a ShardedUpstream of n in-memory shards.
+func newTestShards(n, replicas int) (*ShardedUpstream, []*memUpstream) {
+	s := &ShardedUpstream{Replicas: replicas}
+	var mems []*memUpstream
+	for i := 0; i < n; i++ {
+		mem := newMemUpstream()
+		mems = append(mems, mem)
+		s.Shards = append(s.Shards, Shard{Name: fmt.Sprintf("http://shard%d", i), Upstream: mem})
+	}
+	return s, mems
+}
+
+func shardNames(shards []*Shard) map[string]bool {
+	names := make(map[string]bool)
+	for _, sh := range shards {
+		names[sh.Name] = true
+	}
+	return names
+}
+
+func TestShardPlacement(t *testing.T) {
+	s, _ := newTestShards(5, 2)
+	grown, _ := newTestShards(6, 2)
+	counts := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := testActionID(fmt.Sprint(i))
+		shards, err := s.shardsFor(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		old := shardNames(shards)
+		if len(old) != 2 {
+			t.Fatalf("key %d is on %d distinct shards; want 2", i, len(old))
+		}
+		for name := range old {
+			counts[name]++
+		}
+		again, _ := s.shardsFor(key)
+		if fmt.Sprint(shardNames(again)) != fmt.Sprint(old) {
+			t.Fatalf("key %d moved from %v to %v", i, old, shardNames(again))
+		}
+
+		// Adding a shard only moves keys onto the new one.
+		moved, _ := grown.shardsFor(key)
+		for name := range shardNames(moved) {
+			if !old[name] && name != "http://shard5" {
+				t.Errorf("key %d moved to %s after adding a shard; was on %v", i, name, old)
+			}
+		}
+	}
+	for name, n := range counts {
+		if n < 250 || n > 550 {
+			t.Errorf("shard %s has %d of 2000 placements; want about 400", name, n)
+		}
+	}
+}
+
+func TestShardedPut(t *testing.T) {
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		s, mems := newTestShards(5, 2)
+		data := fmt.Sprintf("output %d", i)
+		actionID, outputID := testActionID(fmt.Sprint(i)), testOutput(data)
+		if err := s.Put(ctx, actionID, outputID, int64(len(data)), bytes.NewReader([]byte(data))); err != nil {
+			t.Fatalf("Put: %v", err)
+		}
+		outputShards, _ := s.shardsFor(outputID)
+		actionShards, _ := s.shardsFor(actionID)
+		want := shardNames(outputShards)
+		for name := range shardNames(actionShards) {
+			want[name] = true
+		}
+		for j, mem := range mems {
+			name := s.Shards[j].Name
+			_, hasOutput := mem.outputs[outputID]
+			if hasOutput != want[name] {
+				t.Errorf("Put %d: shard %s has output %v; want %v", i, name, hasOutput, want[name])
+			}
+			wantPuts := 0
+			if want[name] {
+				wantPuts = 1
+			}
+			if mem.puts != wantPuts {
+				t.Errorf("Put %d: shard %s got %d Puts; want %d", i, name, mem.puts, wantPuts)
+			}
+			if mem.getOutputs != 0 || mem.putActions != 0 {
+				t.Errorf("Put %d: shard %s got %d GetOutputs and %d PutActions; want none", i, name, mem.getOutputs, mem.putActions)
+			}
+		}
+		for _, sh := range actionShards {
+			if av, err := sh.Upstream.GetAction(ctx, actionID); err != nil || av.OutputID != outputID {
+				t.Errorf("Put %d: action shard %s has %+v, %v", i, sh.Name, av, err)
+			}
+		}
+	}
+}
+
+func TestShardMarkedDown(t *testing.T) {
+	ctx := context.Background()
+	s, mems := newTestShards(3, 1)
+	actionID := testActionID("a")
+	shards, _ := s.shardsFor(actionID)
+	first := shards[0]
+	var firstMem *memUpstream
+	for i := range s.Shards {
+		if &s.Shards[i] == first {
+			firstMem = mems[i]
+		}
+	}
+
+	// Misses don't mark a shard down.
+	if _, err := s.GetAction(ctx, actionID); IgnoreNotFound(err) != nil {
+		t.Fatalf("GetAction: %v", err)
+	}
+	if shards, _ := s.shardsFor(actionID); shards[0] != first {
+		t.Fatalf("shard %s was marked down after a miss", first.Name)
+	}
+
+	firstMem.err = &StatusError{StatusCode: 503, Status: "503 Service Unavailable"}
+	if _, err := s.GetAction(ctx, actionID); err == nil {
+		t.Fatalf("GetAction from a failing shard succeeded")
+	}
+	shards, err := s.shardsFor(actionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shards[0] == first {
+		t.Fatalf("shard %s wasn't marked down after a 503", first.Name)
+	}
+	// Writes go to the next shard in the key's ranking meanwhile.
+	const data = "x"
+	if err := s.Put(ctx, actionID, testOutput(data), 1, bytes.NewReader([]byte(data))); err != nil {
+		t.Fatalf("Put with a shard down: %v", err)
+	}
+	if av, err := s.GetAction(ctx, actionID); err != nil || av.OutputID != testOutput(data) {
+		t.Errorf("GetAction with a shard down = %+v, %v", av, err)
+	}
+
+	s.mu.Lock()
+	for _, sh := range s.Shards {
+		s.downUntil[sh.Name] = s.downUntil[sh.Name].AddDate(-1, 0, 0)
+	}
+	s.mu.Unlock()
+	if shards, _ := s.shardsFor(actionID); shards[0] != first {
+		t.Errorf("shard %s still skipped after its down time", first.Name)
+	}
+}
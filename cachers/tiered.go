@@ -0,0 +1,376 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// Tier is one level of a TieredUpstream.
+type Tier struct {
+	// Name identifies the tier in logs and errors, like "cache-server".
+	Name string
+
+	Upstream Upstream
+
+	// NoPut means that Puts are never sent to this tier. It's still read from
+	// and, if enabled, backfilled.
+	NoPut bool
+
+	// IgnorePutErrors means that a failed Put to this tier is logged rather
+	// than failing the whole Put.
+	IgnorePutErrors bool
+}
+
+// TieredUpstream is an Upstream composed of several upstreams ordered from
+// fastest to slowest, like an in-office cache server in front of blob storage.
+//
+// Gets are tried against each tier in order until one hits. Puts are written
+// to every tier that accepts them, in parallel.
+type TieredUpstream struct {
+	Tiers []Tier
+
+	// Backfill optionally specifies that entries found in a slower tier are
+	// copied into the faster tiers that missed them, as the output is read.
+	Backfill bool
+
+	// Verbose optionally specifies whether to log verbose messages.
+	Verbose bool
+
+	mu      sync.Mutex
+	pending map[string][]backfill // keyed by outputID; guarded by mu
+}
+
+var _ Upstream = (*TieredUpstream)(nil)
+
+// backfill is an action found in a slower tier that still needs its output
+// written to the faster tiers.
+type backfill struct {
+	actionID string
+	size     int64
+	found    int // index of the tier that hit
+}
+
+// maxPendingBackfills bounds how many actions may wait for their output to
+// be read, in case the caller never asks for it.
+const maxPendingBackfills = 1024
+
+func (t *TieredUpstream) GetAction(ctx context.Context, actionID string) (*ActionValue, error) {
+	var firstErr error
+	for i, tier := range t.Tiers {
+		av, err := tier.Upstream.GetAction(ctx, actionID)
+		if err != nil {
+			if IgnoreNotFound(err) != nil {
+				if t.Verbose {
+					log.Printf("tier %s: GetAction(%s): %v", tier.Name, actionID, err)
+				}
+				if firstErr == nil {
+					firstErr = fmt.Errorf("tier %s: %w", tier.Name, err)
+				}
+			}
+			continue
+		}
+		if t.Backfill && i > 0 {
+			t.startBackfill(ctx, actionID, av, i)
+		}
+		return av, nil
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, errNotFound
+}
+
+func (t *TieredUpstream) startBackfill(ctx context.Context, actionID string, av *ActionValue, found int) {
+	if av.Size == 0 {
+		// There's no output to wait for.
+		t.putTiers(ctx, t.backfillTiers(found), actionID, av.OutputID, 0, bytes.NewReader(nil))
+		return
+	}
+	if data := av.inlineData(); data != nil {
+		// Nor is there when it's inline, as it won't be fetched.
+		t.putTiers(ctx, t.backfillTiers(found), actionID, av.OutputID, av.Size, bytes.NewReader(data))
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pending == nil || len(t.pending) >= maxPendingBackfills {
+		t.pending = make(map[string][]backfill)
+	}
+	t.pending[av.OutputID] = append(t.pending[av.OutputID], backfill{actionID, av.Size, found})
+}
+
+// backfillTiers returns the indexes of the tiers faster than found that
+// accept Puts.
+func (t *TieredUpstream) backfillTiers(found int) []int {
+	var idx []int
+	for i := 0; i < found; i++ {
+		if !t.Tiers[i].NoPut {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+func (t *TieredUpstream) GetOutput(ctx context.Context, outputID string) (io.ReadCloser, error) {
+	t.mu.Lock()
+	bfs := t.pending[outputID]
+	delete(t.pending, outputID)
+	t.mu.Unlock()
+
+	var firstErr error
+	for i, tier := range t.Tiers {
+		body, err := tier.Upstream.GetOutput(ctx, outputID)
+		if err != nil {
+			if IgnoreNotFound(err) != nil {
+				if t.Verbose {
+					log.Printf("tier %s: GetOutput(%s): %v", tier.Name, outputID, err)
+				}
+				if firstErr == nil {
+					firstErr = fmt.Errorf("tier %s: %w", tier.Name, err)
+				}
+			}
+			continue
+		}
+		if len(bfs) == 0 {
+			return body, nil
+		}
+		if i == 0 {
+			// The output got to the fastest tier since its actions were
+			// looked up, so they only need recording.
+			t.backfillActions(ctx, outputID, bfs)
+			return body, nil
+		}
+		return t.backfillReader(ctx, outputID, body, bfs), nil
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, errNotFound
+}
+
+// backfillActions records the actions in bfs on the tiers that missed them,
+// which already have their output.
+func (t *TieredUpstream) backfillActions(ctx context.Context, outputID string, bfs []backfill) {
+	for _, bf := range bfs {
+		for _, i := range t.backfillTiers(bf.found) {
+			tier := t.Tiers[i]
+			err := tier.Upstream.PutAction(ctx, bf.actionID, outputID, bf.size)
+			if err != nil && t.Verbose {
+				log.Printf("tier %s: backfill of action %s: %v", tier.Name, bf.actionID, err)
+			}
+		}
+	}
+}
+
+// backfillReader returns a ReadCloser that reads from body while also
+// writing what it reads to the tiers that missed the actions in bfs.
+func (t *TieredUpstream) backfillReader(ctx context.Context, outputID string, body io.ReadCloser, bfs []backfill) io.ReadCloser {
+	br := &backfillReadCloser{body: body}
+	for _, bf := range bfs {
+		for _, i := range t.backfillTiers(bf.found) {
+			tier := t.Tiers[i]
+			pr, pw := io.Pipe()
+			br.fw.ws = append(br.fw.ws, pw)
+			br.wg.Add(1)
+			go func(bf backfill) {
+				defer br.wg.Done()
+				err := tier.Upstream.Put(ctx, bf.actionID, outputID, bf.size, pr)
+				pr.CloseWithError(err) // unblock the writer if Put returned early
+				if err != nil && t.Verbose {
+					log.Printf("tier %s: backfill of action %s: %v", tier.Name, bf.actionID, err)
+				}
+			}(bf)
+		}
+	}
+	return br
+}
+
+type backfillReadCloser struct {
+	body io.ReadCloser
+	fw   fanoutWriter
+	eof  bool
+	wg   sync.WaitGroup
+}
+
+func (br *backfillReadCloser) Read(p []byte) (int, error) {
+	n, err := br.body.Read(p)
+	if n > 0 {
+		br.fw.Write(p[:n])
+	}
+	if err == io.EOF {
+		br.eof = true
+	}
+	return n, err
+}
+
+// Close closes the underlying body and waits for the backfill Puts to
+// finish. If the body wasn't read to EOF, the backfills are aborted.
+func (br *backfillReadCloser) Close() error {
+	err := br.body.Close()
+	if br.eof {
+		br.fw.Close()
+	} else {
+		br.fw.CloseWithError(errors.New("backfill source not fully read"))
+	}
+	br.wg.Wait()
+	return err
+}
+
+// fanoutWriter writes to each of ws, dropping any writer that fails.
+// Writes to it never fail, so a source can always be drained.
+type fanoutWriter struct {
+	ws     []*io.PipeWriter
+	failed []bool
+}
+
+func (fw *fanoutWriter) Write(p []byte) (int, error) {
+	if fw.failed == nil {
+		fw.failed = make([]bool, len(fw.ws))
+	}
+	for i, w := range fw.ws {
+		if fw.failed[i] {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			fw.failed[i] = true
+		}
+	}
+	return len(p), nil
+}
+
+func (fw *fanoutWriter) Close() {
+	for _, w := range fw.ws {
+		w.Close()
+	}
+}
+
+func (fw *fanoutWriter) CloseWithError(err error) {
+	for _, w := range fw.ws {
+		w.CloseWithError(err)
+	}
+}
+
+func (t *TieredUpstream) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	return t.putTiers(ctx, t.putTierIndexes(), actionID, outputID, size, body)
+}
+
+func (t *TieredUpstream) putTierIndexes() []int {
+	var idx []int
+	for i, tier := range t.Tiers {
+		if !tier.NoPut {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// HasOutput reports whether every tier that accepts Puts already has the
+// output, so that PutAction alone suffices to store an action for it.
+func (t *TieredUpstream) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	for _, i := range t.putTierIndexes() {
+		tier := t.Tiers[i]
+		has, err := tier.Upstream.HasOutput(ctx, outputID)
+		if err != nil {
+			return false, fmt.Errorf("tier %s: %w", tier.Name, err)
+		}
+		if !has {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (t *TieredUpstream) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	idx := t.putTierIndexes()
+	errs := make([]error, len(idx))
+	var wg sync.WaitGroup
+	for n, i := range idx {
+		wg.Add(1)
+		go func(n int, tier Tier) {
+			defer wg.Done()
+			errs[n] = tier.Upstream.PutAction(ctx, actionID, outputID, size)
+		}(n, t.Tiers[i])
+	}
+	wg.Wait()
+	return t.putErrors(idx, errs, actionID, outputID)
+}
+
+// putTiers writes body to each of the tiers in idx in parallel.
+//
+// If body is an io.ReaderAt and io.Seeker, like an *io.SectionReader of a
+// local file, each tier gets its own independent reader, so that tiers can
+// retry their Puts. Otherwise body is streamed to all tiers at once, and is
+// consumed completely even if every tier fails.
+func (t *TieredUpstream) putTiers(ctx context.Context, idx []int, actionID, outputID string, size int64, body io.Reader) error {
+	errs := make([]error, len(idx))
+	var wg sync.WaitGroup
+	var fw fanoutWriter
+	ra, _ := body.(io.ReaderAt)
+	rs, _ := body.(io.Seeker)
+	var start int64
+	if ra != nil && rs != nil {
+		var err error
+		if start, err = rs.Seek(0, io.SeekCurrent); err != nil {
+			ra = nil
+		}
+	} else {
+		ra = nil
+	}
+	for n, i := range idx {
+		var putBody io.Reader
+		if size == 0 {
+			putBody = bytes.NewReader(nil)
+		} else if ra != nil {
+			putBody = io.NewSectionReader(ra, start, size)
+		} else {
+			pr, pw := io.Pipe()
+			fw.ws = append(fw.ws, pw)
+			putBody = pr
+		}
+		wg.Add(1)
+		go func(n int, tier Tier, putBody io.Reader) {
+			defer wg.Done()
+			errs[n] = tier.Upstream.Put(ctx, actionID, outputID, size, putBody)
+			if pr, ok := putBody.(*io.PipeReader); ok {
+				pr.CloseWithError(errs[n]) // unblock the writer if Put returned early
+			}
+		}(n, t.Tiers[i], putBody)
+	}
+	var copyErr error
+	if size != 0 && ra == nil {
+		if _, copyErr = io.Copy(&fw, body); copyErr != nil {
+			fw.CloseWithError(copyErr)
+		} else {
+			fw.Close()
+		}
+	}
+	wg.Wait()
+	if copyErr != nil {
+		return copyErr
+	}
+
+	return t.putErrors(idx, errs, actionID, outputID)
+}
+
+// putErrors combines the errors of Puts to the tiers in idx, dropping those
+// of tiers that ignore Put errors.
+func (t *TieredUpstream) putErrors(idx []int, errs []error, actionID, outputID string) error {
+	var failed []error
+	for n, i := range idx {
+		if errs[n] == nil {
+			continue
+		}
+		tier := t.Tiers[i]
+		if tier.IgnorePutErrors {
+			log.Printf("tier %s: ignoring Put(%s, %s) error: %v", tier.Name, actionID, outputID, errs[n])
+			continue
+		}
+		failed = append(failed, fmt.Errorf("tier %s: %w", tier.Name, errs[n]))
+	}
+	return errors.Join(failed...)
+}
@@ -0,0 +1,127 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+)
+
+// newTestTiers returns a fast and a slow tier, with an action and its
+// output stored only in the slow one.
+func newTestTiers(data string) (fast, slow *memUpstream, actionID, outputID string) {
+	fast, slow = newMemUpstream(), newMemUpstream()
+	actionID, outputID = testActionID("a"), testOutput(data)
+	slow.Put(context.Background(), actionID, outputID, int64(len(data)), bytes.NewReader([]byte(data)))
+	slow.puts = 0
+	return fast, slow, actionID, outputID
+}
+
+func TestTieredBackfill(t *testing.T) {
+	ctx := context.Background()
+	const data = "slow tier output"
+	fast, slow, actionID, outputID := newTestTiers(data)
+	tu := &TieredUpstream{
+		Tiers:    []Tier{{Name: "fast", Upstream: fast}, {Name: "slow", Upstream: slow}},
+		Backfill: true,
+	}
+	wu := &WithUpstream{Upstream: tu, Local: &DiskCache{Dir: t.TempDir()}}
+	if gotOutput, _, err := wu.Get(ctx, actionID); err != nil || gotOutput != outputID {
+		t.Fatalf("Get = %q, %v; want %q", gotOutput, err, outputID)
+	}
+	if !fast.has(actionID) || string(fast.outputs[outputID]) != data {
+		t.Errorf("fast tier wasn't backfilled: has action %v, output %q", fast.has(actionID), fast.outputs[outputID])
+	}
+	if slow.puts != 0 {
+		t.Errorf("slow tier got %d Puts; want 0", slow.puts)
+	}
+}
+
+func TestTieredBackfillOutputAlreadyInFastTier(t *testing.T) {
+	ctx := context.Background()
+	const data = "output that got to the fast tier meanwhile"
+	fast, slow, actionID, outputID := newTestTiers(data)
+	tu := &TieredUpstream{
+		Tiers:    []Tier{{Name: "fast", Upstream: fast}, {Name: "slow", Upstream: slow}},
+		Backfill: true,
+	}
+	if _, err := tu.GetAction(ctx, actionID); err != nil {
+		t.Fatal(err)
+	}
+	// Another action with the same output is written to the fast tier
+	// before the output is fetched.
+	fast.Put(ctx, testActionID("b"), outputID, int64(len(data)), bytes.NewReader([]byte(data)))
+	fast.puts = 0
+	body, err := tu.GetOutput(ctx, outputID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, body)
+	body.Close()
+	if av, err := fast.GetAction(ctx, actionID); err != nil || av.OutputID != outputID {
+		t.Errorf("fast tier's action = %+v, %v; want it backfilled", av, err)
+	}
+	if fast.puts != 0 || slow.getOutputs != 0 {
+		t.Errorf("fast tier got %d Puts and slow tier %d GetOutputs; want 0", fast.puts, slow.getOutputs)
+	}
+}
+
+func TestTieredBackfillAbortedOnPartialRead(t *testing.T) {
+	ctx := context.Background()
+	const data = "an output that isn't read to the end"
+	fast, slow, actionID, outputID := newTestTiers(data)
+	tu := &TieredUpstream{
+		Tiers:    []Tier{{Name: "fast", Upstream: fast}, {Name: "slow", Upstream: slow}},
+		Backfill: true,
+	}
+	if _, err := tu.GetAction(ctx, actionID); err != nil {
+		t.Fatal(err)
+	}
+	body, err := tu.GetOutput(ctx, outputID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadFull(body, make([]byte, 5))
+	body.Close()
+	if fast.has(actionID) || fast.outputs[outputID] != nil {
+		t.Errorf("fast tier was backfilled from a partially read output")
+	}
+}
+
+func TestTieredBackfillSkips(t *testing.T) {
+	ctx := context.Background()
+	const data = "inline"
+	tests := []struct {
+		name       string
+		noPut      bool
+		backfill   bool
+		inline     bool
+		wantFilled bool
+	}{
+		{name: "disabled", backfill: false, wantFilled: false},
+		{name: "NoPut tier", noPut: true, backfill: true, wantFilled: false},
+		{name: "inline", backfill: true, inline: true, wantFilled: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fast, slow, actionID, outputID := newTestTiers(data)
+			if tt.inline {
+				slow.actions[actionID].Data = []byte(data)
+			}
+			tu := &TieredUpstream{
+				Tiers:    []Tier{{Name: "fast", Upstream: fast, NoPut: tt.noPut}, {Name: "slow", Upstream: slow}},
+				Backfill: tt.backfill,
+			}
+			wu := &WithUpstream{Upstream: tu, Local: &DiskCache{Dir: t.TempDir()}}
+			if gotOutput, _, err := wu.Get(ctx, actionID); err != nil || gotOutput != outputID {
+				t.Fatalf("Get = %q, %v; want %q", gotOutput, err, outputID)
+			}
+			if got := fast.has(actionID); got != tt.wantFilled {
+				t.Errorf("fast tier has the action: %v; want %v", got, tt.wantFilled)
+			}
+			if tt.inline && slow.getOutputs != 0 {
+				t.Errorf("slow tier got %d GetOutputs for an inline output; want 0", slow.getOutputs)
+			}
+		})
+	}
+}
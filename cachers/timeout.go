@@ -0,0 +1,98 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// TimeoutError is the error returned by HTTPRemote when connecting to the
+// server, the TLS handshake, or waiting for response headers takes longer
+// than its DialTimeout, TLSHandshakeTimeout or ResponseHeaderTimeout.
+//
+// It deliberately doesn't unwrap to Err, which may be a context error, so
+// that it isn't mistaken for the caller's context ending.
+type TimeoutError struct {
+	Method string
+	Path   string
+	Phase  string        // "dial", "TLS handshake" or "response headers"
+	Limit  time.Duration // the timeout that was exceeded
+	Err    error         // the underlying error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("%s %s: %s timed out after %v", e.Method, e.Path, e.Phase, e.Limit)
+}
+
+// Timeout reports true, for net.Error.
+func (e *TimeoutError) Timeout() bool { return true }
+
+// Temporary reports true, as the request might succeed if retried.
+func (e *TimeoutError) Temporary() bool { return true }
+
+// send sends req with hc, applying ResponseHeaderTimeout and turning
+// timeouts into *TimeoutErrors.
+func (r *HTTPRemote) send(hc *http.Client, req *http.Request) (*http.Response, error) {
+	callerCtx := req.Context()
+	if r.ResponseHeaderTimeout <= 0 {
+		res, err := hc.Do(req)
+		return res, r.timeoutError(callerCtx, req, err)
+	}
+
+	// This is done here rather than with http.Transport's
+	// ResponseHeaderTimeout so that it works for every transport,
+	// including cleartext HTTP/2.
+	ctx, cancel := context.WithCancel(callerCtx)
+	timer := time.AfterFunc(r.ResponseHeaderTimeout, cancel)
+	res, err := hc.Do(req.WithContext(ctx))
+	if timer.Stop() {
+		if err != nil {
+			cancel()
+			return nil, r.timeoutError(callerCtx, req, err)
+		}
+		// The deadline doesn't apply to reading the body, but the
+		// context has to be released once it's done.
+		res.Body = &cancelOnClose{res.Body, cancel}
+		return res, nil
+	}
+	// The timer fired, maybe just as the headers arrived.
+	if err == nil {
+		res.Body.Close()
+	}
+	if callerCtx.Err() != nil {
+		return nil, callerCtx.Err()
+	}
+	return nil, &TimeoutError{
+		Method: req.Method,
+		Path:   req.URL.Path,
+		Phase:  "response headers",
+		Limit:  r.ResponseHeaderTimeout,
+		Err:    err,
+	}
+}
+
+// timeoutError returns err as a *TimeoutError if it's a dial or TLS
+// handshake timeout, and otherwise err itself. A custom HTTPClient has
+// its own limits, which aren't known, so its errors are left alone.
+func (r *HTTPRemote) timeoutError(callerCtx context.Context, req *http.Request, err error) error {
+	var ne net.Error
+	if err == nil || r.HTTPClient != nil || callerCtx.Err() != nil || !errors.As(err, &ne) || !ne.Timeout() {
+		return err
+	}
+	te := &TimeoutError{Method: req.Method, Path: req.URL.Path, Err: err}
+	var oe *net.OpError
+	switch {
+	case errors.As(err, &oe) && oe.Op == "dial":
+		te.Phase, te.Limit = "dial", r.dialTimeout()
+	case strings.Contains(err.Error(), "TLS handshake timeout"):
+		// net/http's error for this isn't exported.
+		te.Phase, te.Limit = "TLS handshake", r.tlsHandshakeTimeout()
+	default:
+		return err
+	}
+	return te
+}
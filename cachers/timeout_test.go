@@ -0,0 +1,122 @@
+package cachers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	// A server that accepts connections but never says anything.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	r := &HTTPRemote{BaseURL: "https://" + ln.Addr().String(), TLSHandshakeTimeout: 50 * time.Millisecond}
+	_, err = r.GetAction(context.Background(), testActionID("a"))
+	var te *TimeoutError
+	if !errors.As(err, &te) || te.Phase != "TLS handshake" || te.Limit != 50*time.Millisecond {
+		t.Fatalf("GetAction error = %#v; want a TLS handshake *TimeoutError", err)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("TimeoutError unwraps to context.DeadlineExceeded")
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	r := &HTTPRemote{BaseURL: srv.URL, ResponseHeaderTimeout: 50 * time.Millisecond}
+	_, err := r.GetAction(context.Background(), testActionID("a"))
+	var te *TimeoutError
+	if !errors.As(err, &te) || te.Phase != "response headers" {
+		t.Fatalf("GetAction error = %v; want a response headers *TimeoutError", err)
+	}
+
+	// The caller giving up isn't a timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	r.ResponseHeaderTimeout = time.Minute
+	_, err = r.GetAction(ctx, testActionID("a"))
+	if errors.As(err, &te) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("GetAction with an expired context = %v; want context.DeadlineExceeded", err)
+	}
+}
+
+// netTimeout is a net.Error that timed out.
+type netTimeout struct{}
+
+func (netTimeout) Error() string   { return "i/o timeout" }
+func (netTimeout) Timeout() bool   { return true }
+func (netTimeout) Temporary() bool { return true }
+
+func TestTimeoutErrorClassification(t *testing.T) {
+	req := httptest.NewRequest("GET", "/action/x", nil)
+	tests := []struct {
+		name      string
+		err       error
+		wantPhase string // empty for err to be returned as is
+	}{
+		{"nil", nil, ""},
+		{"dial", &url.Error{Op: "Get", URL: "http://x", Err: &net.OpError{Op: "dial", Net: "tcp", Err: netTimeout{}}}, "dial"},
+		{"read", &url.Error{Op: "Get", URL: "http://x", Err: &net.OpError{Op: "read", Net: "tcp", Err: netTimeout{}}}, ""},
+		{"refused", &url.Error{Op: "Get", URL: "http://x", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}, ""},
+		{"not a net.Error", errors.New("TLS handshake timeout"), ""},
+	}
+	r := &HTTPRemote{DialTimeout: time.Second}
+	for _, tt := range tests {
+		err := r.timeoutError(context.Background(), req, tt.err)
+		var te *TimeoutError
+		if tt.wantPhase == "" {
+			if err != tt.err {
+				t.Errorf("%s: got %v; want the error unchanged", tt.name, err)
+			}
+			continue
+		}
+		if !errors.As(err, &te) || te.Phase != tt.wantPhase || te.Limit != time.Second {
+			t.Errorf("%s: got %#v; want a %s *TimeoutError after 1s", tt.name, err, tt.wantPhase)
+		}
+	}
+}
+
+func TestProxyURL(t *testing.T) {
+	tests := []struct {
+		proxy   string
+		h2c     bool
+		wantErr bool
+	}{
+		{"", false, false},
+		{"direct", false, false},
+		{"http://proxy:3128", false, false},
+		{"https://proxy:3128", false, false},
+		{"proxy:3128", false, true},
+		{"socks5://proxy:1080", false, true},
+		{"http://", false, true},
+		{"direct", true, false},
+		{"http://proxy:3128", true, true},
+	}
+	for _, tt := range tests {
+		r := &HTTPRemote{BaseURL: "http://cache:31364", Proxy: tt.proxy, PreferHTTP2: tt.h2c}
+		_, err := r.newClient()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Proxy %q, PreferHTTP2 %v: newClient error = %v; want error %v", tt.proxy, tt.h2c, err, tt.wantErr)
+		}
+	}
+}
@@ -21,10 +21,43 @@ type Cache interface {
 	) (diskPath string, err error)
 }
 
+// OutputStore is implemented by caches that can look up outputs directly by
+// their output ID, rather than through an action that produced them.
+type OutputStore interface {
+	// OutputPath returns the disk path of the output with the given
+	// outputID, or the empty string if it isn't in the cache.
+	OutputPath(ctx context.Context, outputID string) (diskPath string, err error)
+}
+
 // ActionValue is the JSON value returned by the upstream cacher server for a GetAction request.
 type ActionValue struct {
 	OutputID string `json:"outputID"`
 	Size     int64  `json:"size"`
+
+	// Data optionally holds the output itself, base64 in JSON, for outputs
+	// small enough that the server inlines them, saving a GetOutput.
+	Data []byte `json:"data,omitempty"`
+}
+
+// inlineData returns av's inline output, or nil if it has none or it
+// doesn't match av.Size.
+func (av *ActionValue) inlineData() []byte {
+	if av.Data == nil || int64(len(av.Data)) != av.Size {
+		return nil
+	}
+	return av.Data
+}
+
+// BatchGetActionsRequest is the JSON body of a batch action lookup sent to
+// the cacher server's /actions:batchGet endpoint.
+type BatchGetActionsRequest struct {
+	ActionIDs []string `json:"actionIDs"`
+}
+
+// BatchGetActionsResponse is the JSON response to a BatchGetActionsRequest.
+// Actions that weren't found are omitted.
+type BatchGetActionsResponse struct {
+	Actions map[string]*ActionValue `json:"actions"`
 }
 
 // Upstream provides access to the upstream cacher server.
@@ -35,13 +68,25 @@ type Upstream interface {
 	GetOutput(ctx context.Context, outputID string) (body io.ReadCloser, err error)
 	// Put stores an action with the given output id and body in upstream.
 	Put(ctx context.Context, actionID string, outputID string, size int64, body io.Reader) error
+	// HasOutput reports whether the output body for the given outputID is
+	// already stored in upstream.
+	HasOutput(ctx context.Context, outputID string) (bool, error)
+	// PutAction stores an action whose output, of the given size, is already
+	// stored in upstream. It's the cheap half of Put for outputs that
+	// HasOutput reports as present. If the output has gone missing since,
+	// it returns an error that IgnoreNotFound ignores.
+	PutAction(ctx context.Context, actionID string, outputID string, size int64) error
 }
 
 var errNotFound = errors.New("not found")
 
+// ErrNotFound is the error Upstreams return for missing entries. Those
+// outside this package return it so that IgnoreNotFound ignores their misses.
+var ErrNotFound = errNotFound
+
 func IgnoreNotFound(err error) error {
 	if errors.Is(err, errNotFound) {
 		return nil
 	}
 	return err
-}
\ No newline at end of file
+}
@@ -3,15 +3,175 @@ package cachers
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// UpstreamPolicy controls which directions of traffic WithUpstream sends to
+// its Upstream.
+type UpstreamPolicy int
+
+const (
+	// PolicyReadWrite consults the upstream on Get and writes to it on Put.
+	// It's the zero value.
+	PolicyReadWrite UpstreamPolicy = iota
+	// PolicyReadOnly consults the upstream on Get but only writes Puts to
+	// the local cache.
+	PolicyReadOnly
+	// PolicyWriteOnly writes Puts to the upstream but never consults it on
+	// Get.
+	PolicyWriteOnly
+	// PolicyDisabled never talks to the upstream.
+	PolicyDisabled
+)
+
+func (p UpstreamPolicy) String() string {
+	switch p {
+	case PolicyReadWrite:
+		return "read-write"
+	case PolicyReadOnly:
+		return "read-only"
+	case PolicyWriteOnly:
+		return "write-only"
+	case PolicyDisabled:
+		return "disabled"
+	}
+	return fmt.Sprintf("UpstreamPolicy(%d)", int(p))
+}
+
+// CanRead reports whether p allows Gets to consult the upstream.
+func (p UpstreamPolicy) CanRead() bool {
+	return p == PolicyReadWrite || p == PolicyReadOnly
+}
+
+// CanWrite reports whether p allows Puts to be written to the upstream.
+func (p UpstreamPolicy) CanWrite() bool {
+	return p == PolicyReadWrite || p == PolicyWriteOnly
+}
+
+// ParseUpstreamPolicy parses a policy name as returned by UpstreamPolicy.String.
+// The empty string means PolicyReadWrite.
+func ParseUpstreamPolicy(s string) (UpstreamPolicy, error) {
+	switch s {
+	case "", "read-write", "rw":
+		return PolicyReadWrite, nil
+	case "read-only", "ro":
+		return PolicyReadOnly, nil
+	case "write-only", "wo":
+		return PolicyWriteOnly, nil
+	case "disabled", "off":
+		return PolicyDisabled, nil
+	}
+	return 0, fmt.Errorf("unknown upstream policy %q; want read-write, read-only, write-only or disabled", s)
+}
+
 type WithUpstream struct {
 	Upstream Upstream
 	Local    Cache // usually a disk cache
+
+	// Policy optionally restricts which operations are sent to Upstream.
+	// The zero value is PolicyReadWrite.
+	Policy UpstreamPolicy
+
+	// PutMinSize and PutMaxSize optionally bound the size of outputs that
+	// are written to Upstream. Outputs outside the bounds are only stored in
+	// Local. Zero means no bound.
+	PutMinSize int64
+	PutMaxSize int64
+
+	// GetMaxSize optionally specifies the size of the largest output to
+	// download from Upstream. Larger outputs are treated as misses.
+	// Zero means no limit.
+	GetMaxSize int64
+
+	// SkippedPuts and SkippedGets count the operations that weren't sent to
+	// Upstream because of the size limits above.
+	SkippedPuts atomic.Int64
+	SkippedGets atomic.Int64
+
+	// AsyncPuts optionally specifies that writes are forwarded to Upstream
+	// in the background, so Put returns once Local has the output. Errors
+	// are then logged and counted in AsyncPutErrors. Use Wait to wait for
+	// writes in progress.
+	AsyncPuts      bool
+	AsyncPutErrors atomic.Int64
+
+	// MaxAsyncPuts optionally bounds how many AsyncPuts writes may be in
+	// progress at once. Past it, writes are forwarded before returning, so
+	// that a slow Upstream slows down writers rather than piling up
+	// goroutines. Zero means no limit.
+	MaxAsyncPuts int
+
+	// AsyncPutTimeout optionally bounds how long each AsyncPuts write may
+	// take. Zero means no bound.
+	AsyncPutTimeout time.Duration
+
+	// GetActionTimeout and GetOutputTimeout optionally bound how long Get
+	// waits for Upstream to look up an action and to download its output.
+	// Past either, Get reports a miss, so that cmd/go rebuilds rather than
+	// waits, and the download carries on in the background into Local, so
+	// that the next build hits. Use Wait to wait for those downloads.
+	// Zero means no bound.
+	GetActionTimeout time.Duration
+	GetOutputTimeout time.Duration
+
+	// GetOutputRate optionally extends GetOutputTimeout by the time it
+	// takes to download the output at this many bytes per second, so that
+	// large outputs get longer.
+	GetOutputRate int64
+
+	// BackgroundGetTimeout optionally bounds how long a lookup and
+	// download may take in all, including in the background after Get
+	// stopped waiting for it. If zero, the lookup and the download may each
+	// take backgroundGetFactor times as long as Get waits for them.
+	BackgroundGetTimeout time.Duration
+
+	// BackgroundGets counts the Gets that timed out and were left to
+	// finish in the background.
+	BackgroundGets atomic.Int64
+
+	// Verbose optionally specifies whether to log verbose messages.
+	Verbose bool
+
+	async         sync.WaitGroup
+	asyncPutsOnce sync.Once
+	asyncPuts     chan struct{} // semaphore for MaxAsyncPuts; nil if unlimited
+
+	bgMu   sync.Mutex
+	bgGets map[string]bool // action IDs downloading in the background; guarded by bgMu
+}
+
+// backgroundGetFactor is how many times longer than a Get waits for it its
+// download may carry on in the background, unless BackgroundGetTimeout
+// says otherwise.
+const backgroundGetFactor = 10
+
+// LocalOutputStore is implemented by Local caches, like DiskCache, that can
+// store outputs and actions separately. WithUpstream's OutputPath and
+// PutAction methods need it.
+type LocalOutputStore interface {
+	OutputStore
+
+	// PutOutput stores an output of the given size, or of any size if size
+	// is negative, without recording an action for it.
+	PutOutput(ctx context.Context, outputID string, size int64, body io.Reader) (diskPath string, err error)
+
+	// PutAction records actionID as producing outputID, which must already
+	// be stored with the given size.
+	PutAction(ctx context.Context, actionID, outputID string, size int64) (diskPath string, err error)
 }
 
-var _ Cache = (*WithUpstream)(nil)
+var (
+	_ Cache            = (*WithUpstream)(nil)
+	_ LocalOutputStore = (*WithUpstream)(nil)
+)
 
 func (wu *WithUpstream) Get(
 	ctx context.Context,
@@ -21,18 +181,39 @@ func (wu *WithUpstream) Get(
 	if err == nil && outputID != "" { // found in local disk
 		return outputID, diskPath, nil
 	}
+	if !wu.Policy.CanRead() {
+		return "", "", err
+	}
+
+	if wu.GetActionTimeout > 0 || wu.GetOutputTimeout > 0 {
+		return wu.getBounded(ctx, actionID)
+	}
+	return wu.getUpstream(ctx, actionID, nil)
+}
 
-	// If not on disk, download it to disk.
+// getUpstream downloads actionID and its output from Upstream into Local.
+// If downloading isn't nil, it's called with the size of the output before
+// it's fetched.
+func (wu *WithUpstream) getUpstream(ctx context.Context, actionID string, downloading func(size int64)) (outputID, diskPath string, err error) {
 	av, err := wu.Upstream.GetAction(ctx, actionID)
 	if err != nil {
 		return "", "", IgnoreNotFound(err)
 	}
 	outputID = av.OutputID
+	if wu.GetMaxSize > 0 && av.Size > wu.GetMaxSize {
+		wu.SkippedGets.Add(1)
+		return "", "", nil
+	}
 
 	var outputBody io.Reader
 	if av.Size == 0 {
 		outputBody = bytes.NewReader(nil)
+	} else if data := av.inlineData(); data != nil {
+		outputBody = bytes.NewReader(data)
 	} else {
+		if downloading != nil {
+			downloading(av.Size)
+		}
 		b, err := wu.Upstream.GetOutput(ctx, outputID)
 		if err != nil {
 			return "", "", IgnoreNotFound(err)
@@ -45,6 +226,127 @@ func (wu *WithUpstream) Get(
 	return outputID, diskPath, err
 }
 
+// getBounded is getUpstream with GetActionTimeout and GetOutputTimeout
+// applied. The download doesn't use ctx, so that it can outlive a Get
+// that stopped waiting for it, but is bounded by backgroundTimeout. While
+// it's in the background, further Gets of the action miss rather than
+// start another.
+func (wu *WithUpstream) getBounded(ctx context.Context, actionID string) (outputID, diskPath string, err error) {
+	wu.bgMu.Lock()
+	inBackground := wu.bgGets[actionID]
+	wu.bgMu.Unlock()
+	if inBackground {
+		return "", "", nil
+	}
+
+	type result struct {
+		outputID, diskPath string
+		err                error
+	}
+	done := make(chan result, 1)
+	downloading := make(chan int64, 1)
+	var abandoned, finished bool // guarded by wu.bgMu
+	bgCtx, cancel := context.WithCancel(context.Background())
+	bgTimer := time.AfterFunc(math.MaxInt64, cancel)
+	setBackgroundTimeout := func(d time.Duration) {
+		if d > 0 {
+			bgTimer.Reset(d)
+		} else {
+			bgTimer.Stop()
+		}
+	}
+	setBackgroundTimeout(wu.backgroundTimeout(-1))
+	wu.async.Add(1)
+	go func() {
+		defer wu.async.Done()
+		defer cancel()
+		defer bgTimer.Stop()
+		var res result
+		res.outputID, res.diskPath, res.err = wu.getUpstream(bgCtx, actionID, func(size int64) {
+			if wu.BackgroundGetTimeout <= 0 {
+				setBackgroundTimeout(wu.backgroundTimeout(size))
+			}
+			downloading <- size
+		})
+		wu.bgMu.Lock()
+		finished = true
+		wasAbandoned := abandoned
+		if abandoned {
+			delete(wu.bgGets, actionID)
+		}
+		wu.bgMu.Unlock()
+		if res.err != nil && wasAbandoned {
+			log.Printf("background Get %s: %v", actionID, res.err)
+		}
+		done <- res
+	}()
+	abandon := func() {
+		wu.bgMu.Lock()
+		defer wu.bgMu.Unlock()
+		abandoned = true
+		if !finished {
+			if wu.bgGets == nil {
+				wu.bgGets = make(map[string]bool)
+			}
+			wu.bgGets[actionID] = true
+		}
+	}
+
+	var timer *time.Timer
+	var timeout <-chan time.Time
+	setTimeout := func(d time.Duration) {
+		if timer != nil {
+			timer.Stop()
+		}
+		timer, timeout = nil, nil
+		if d > 0 {
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+	}
+	defer setTimeout(0)
+	setTimeout(wu.GetActionTimeout)
+	for {
+		select {
+		case res := <-done:
+			return res.outputID, res.diskPath, res.err
+		case size := <-downloading:
+			setTimeout(wu.outputTimeout(size))
+		case <-timeout:
+			abandon()
+			wu.BackgroundGets.Add(1)
+			return "", "", nil
+		case <-ctx.Done():
+			abandon()
+			return "", "", ctx.Err()
+		}
+	}
+}
+
+// backgroundTimeout returns how long the lookup, if size is negative, or
+// the download of an output of the given size may take, or zero for no
+// limit. Steps that Get waits for without a timeout have no limit either.
+func (wu *WithUpstream) backgroundTimeout(size int64) time.Duration {
+	if wu.BackgroundGetTimeout > 0 {
+		return wu.BackgroundGetTimeout
+	}
+	d := wu.GetActionTimeout
+	if size >= 0 {
+		d = wu.outputTimeout(size)
+	}
+	return backgroundGetFactor * d
+}
+
+// outputTimeout returns how long Get waits for an output of the given
+// size, or zero for no limit.
+func (wu *WithUpstream) outputTimeout(size int64) time.Duration {
+	d := wu.GetOutputTimeout
+	if d > 0 && wu.GetOutputRate > 0 {
+		d += time.Duration(float64(size) / float64(wu.GetOutputRate) * float64(time.Second))
+	}
+	return d
+}
+
 func (wu *WithUpstream) Put(
 	ctx context.Context,
 	actionID string,
@@ -52,44 +354,191 @@ func (wu *WithUpstream) Put(
 	size int64,
 	body io.Reader,
 ) (diskPath string, err error) {
-	// Write to disk locally as we write it remotely, as we need to guarantee
-	// it's on disk locally for the caller.
-	pr, pw := io.Pipe()
-	diskPutCh := make(chan any, 1)
+	if !wu.Policy.CanWrite() {
+		return wu.Local.Put(ctx, actionID, outputID, size, body)
+	}
+
+	// Write to disk locally first, as we need to guarantee it's on disk
+	// locally for the caller. The upload then reads back from that file, so
+	// it can be replayed if the upstream needs to retry it.
+	diskPath, err = wu.Local.Put(ctx, actionID, outputID, size, body)
+	if err != nil {
+		return "", err
+	}
+	if size < wu.PutMinSize || wu.PutMaxSize > 0 && size > wu.PutMaxSize {
+		wu.SkippedPuts.Add(1)
+		return diskPath, nil
+	}
+	err = wu.forward(ctx, "Put "+actionID, func(ctx context.Context) error {
+		return wu.putUpstream(ctx, actionID, outputID, size, diskPath)
+	})
+	if err != nil {
+		return "", err
+	}
+	return diskPath, nil
+}
+
+// forward calls put now, or in the background if AsyncPuts is set and
+// MaxAsyncPuts allows. The op is only used for logging.
+func (wu *WithUpstream) forward(ctx context.Context, op string, put func(context.Context) error) error {
+	if !wu.AsyncPuts || !wu.startAsyncPut() {
+		return put(ctx)
+	}
 	go func() {
-		var putBody io.Reader = pr
-		if size == 0 {
-			putBody = bytes.NewReader(nil)
+		defer wu.async.Done()
+		if wu.asyncPuts != nil {
+			defer func() { <-wu.asyncPuts }()
 		}
-		diskPath, err := wu.Local.Put(ctx, actionID, outputID, size, putBody)
-		if err != nil {
-			diskPutCh <- err
-		} else {
-			diskPutCh <- diskPath
+		// The caller's context may end when it returns.
+		ctx := context.Background()
+		if wu.AsyncPutTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, wu.AsyncPutTimeout)
+			defer cancel()
+		}
+		if err := put(ctx); err != nil {
+			wu.AsyncPutErrors.Add(1)
+			log.Printf("upstream %s: %v", op, err)
 		}
 	}()
+	return nil
+}
 
-	var putBody io.Reader
+// startAsyncPut reserves a slot for a background write, reporting false
+// if MaxAsyncPuts are already in progress.
+func (wu *WithUpstream) startAsyncPut() bool {
+	wu.asyncPutsOnce.Do(func() {
+		if wu.MaxAsyncPuts > 0 {
+			wu.asyncPuts = make(chan struct{}, wu.MaxAsyncPuts)
+		}
+	})
+	if wu.asyncPuts != nil {
+		select {
+		case wu.asyncPuts <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	wu.async.Add(1)
+	return true
+}
+
+// Wait waits for the writes to Upstream started by AsyncPuts, and the
+// downloads of Gets that timed out, to finish.
+func (wu *WithUpstream) Wait() {
+	wu.async.Wait()
+}
+
+// putUpstream writes an action and its output, which Local stores at
+// diskPath, to Upstream.
+func (wu *WithUpstream) putUpstream(ctx context.Context, actionID, outputID string, size int64, diskPath string) error {
 	if size == 0 {
 		// Special case the empty file so NewRequest sets "Content-Length: 0",
 		// as opposed to thinking we didn't set it and not being able to sniff its size
 		// from the type.
-		putBody = bytes.NewReader(nil)
-	} else {
-		putBody = io.TeeReader(body, pw)
+		return wu.Upstream.Put(ctx, actionID, outputID, 0, bytes.NewReader(nil))
+	}
+
+	// Many actions produce identical outputs. If upstream already has this
+	// one, only the small action record needs to be sent.
+	has, err := wu.Upstream.HasOutput(ctx, outputID)
+	if err != nil && wu.Verbose {
+		log.Printf("upstream HasOutput(%s): %v", outputID, err)
 	}
+	if has {
+		err := wu.Upstream.PutAction(ctx, actionID, outputID, size)
+		if !errors.Is(err, errNotFound) {
+			return err
+		}
+		// The output was evicted or purged since HasOutput; upload it.
+	}
+
+	_, enc, err := StatOutput(diskPath)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if enc != "" {
+		// Stored compressed by a DiskCache with CompressOutputs. This
+		// body can't be replayed, so the upload won't be retried.
+		dec, err := NewDecoder(f, enc)
+		if err != nil {
+			return err
+		}
+		defer dec.Close()
+		return wu.Upstream.Put(ctx, actionID, outputID, size, struct{ io.Reader }{dec})
+	}
+	// A SectionReader hides f's Close method, so the HTTP client doesn't
+	// close the file and prevent retries from seeking back to the start.
+	return wu.Upstream.Put(ctx, actionID, outputID, size, io.NewSectionReader(f, 0, size))
+}
+
+func (wu *WithUpstream) localOutputs() (LocalOutputStore, error) {
+	ls, ok := wu.Local.(LocalOutputStore)
+	if !ok {
+		return nil, fmt.Errorf("local cache %T doesn't implement LocalOutputStore", wu.Local)
+	}
+	return ls, nil
+}
 
-	err = wu.Upstream.Put(ctx, actionID, outputID, size, putBody)
-	pw.Close() // close write
+// OutputPath implements OutputStore, downloading the output from Upstream
+// if Local doesn't have it. Local must implement LocalOutputStore.
+func (wu *WithUpstream) OutputPath(ctx context.Context, outputID string) (diskPath string, err error) {
+	ls, err := wu.localOutputs()
 	if err != nil {
 		return "", err
 	}
+	diskPath, err = ls.OutputPath(ctx, outputID)
+	if err != nil || diskPath != "" || !wu.Policy.CanRead() {
+		return diskPath, err
+	}
+	body, err := wu.Upstream.GetOutput(ctx, outputID)
+	if err != nil {
+		if errors.Is(err, errNotFound) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer body.Close()
+	return ls.PutOutput(ctx, outputID, -1, body)
+}
 
-	// wait for disk to finish writing
-	v := <-diskPutCh
-	if err, ok := v.(error); ok {
+// PutOutput stores an output in Local only. As Upstream has no way to store
+// an output by itself, it's uploaded when PutAction records an action for
+// it. Local must implement LocalOutputStore.
+func (wu *WithUpstream) PutOutput(ctx context.Context, outputID string, size int64, body io.Reader) (diskPath string, err error) {
+	ls, err := wu.localOutputs()
+	if err != nil {
+		return "", err
+	}
+	return ls.PutOutput(ctx, outputID, size, body)
+}
+
+// PutAction records actionID as producing outputID, which must already be
+// in Local with the given size, and forwards the action to Upstream like
+// Put. Local must implement LocalOutputStore.
+func (wu *WithUpstream) PutAction(ctx context.Context, actionID, outputID string, size int64) (diskPath string, err error) {
+	ls, err := wu.localOutputs()
+	if err != nil {
+		return "", err
+	}
+	diskPath, err = ls.PutAction(ctx, actionID, outputID, size)
+	if err != nil || !wu.Policy.CanWrite() {
+		return diskPath, err
+	}
+	if size < wu.PutMinSize || wu.PutMaxSize > 0 && size > wu.PutMaxSize {
+		wu.SkippedPuts.Add(1)
+		return diskPath, nil
+	}
+	err = wu.forward(ctx, "PutAction "+actionID, func(ctx context.Context) error {
+		return wu.putUpstream(ctx, actionID, outputID, size, diskPath)
+	})
+	if err != nil {
 		return "", err
 	}
-	diskPath = v.(string)
 	return diskPath, nil
 }
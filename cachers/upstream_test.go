@@ -0,0 +1,489 @@
+package cachers
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memUpstream is an in-memory Upstream for tests.
+type memUpstream struct {
+	mu      sync.Mutex
+	actions map[string]*ActionValue
+	outputs map[string][]byte
+	err     error // if non-nil, returned by every call
+
+	puts, putActions, getOutputs int
+}
+
+func newMemUpstream() *memUpstream {
+	return &memUpstream{
+		actions: make(map[string]*ActionValue),
+		outputs: make(map[string][]byte),
+	}
+}
+
+func (m *memUpstream) GetAction(ctx context.Context, actionID string) (*ActionValue, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return nil, m.err
+	}
+	av, ok := m.actions[actionID]
+	if !ok {
+		return nil, errNotFound
+	}
+	return av, nil
+}
+
+func (m *memUpstream) GetOutput(ctx context.Context, outputID string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.getOutputs++
+	if m.err != nil {
+		return nil, m.err
+	}
+	data, ok := m.outputs[outputID]
+	if !ok {
+		return nil, errNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (m *memUpstream) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.puts++
+	if m.err != nil {
+		return m.err
+	}
+	m.outputs[outputID] = data
+	m.actions[actionID] = &ActionValue{OutputID: outputID, Size: size}
+	return nil
+}
+
+func (m *memUpstream) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return false, m.err
+	}
+	_, ok := m.outputs[outputID]
+	return ok, nil
+}
+
+func (m *memUpstream) PutAction(ctx context.Context, actionID, outputID string, size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.putActions++
+	if m.err != nil {
+		return m.err
+	}
+	if _, ok := m.outputs[outputID]; !ok {
+		return errNotFound
+	}
+	m.actions[actionID] = &ActionValue{OutputID: outputID, Size: size}
+	return nil
+}
+
+func (m *memUpstream) has(actionID string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.actions[actionID]
+	return ok
+}
+
+// testOutput returns an output ID for data, which is its SHA-256 like
+// cmd/go's.
+func testOutput(data string) (outputID string) {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// testActionID returns an action ID derived from s.
+func testActionID(s string) string {
+	return testOutput("action " + s)
+}
+
+// evictingUpstream reports outputs as present, then forgets them, like a
+// server purging an output between HasOutput and PutAction.
+type evictingUpstream struct {
+	*memUpstream
+}
+
+func (e evictingUpstream) HasOutput(ctx context.Context, outputID string) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.outputs, outputID)
+	return true, nil
+}
+
+func TestPutAfterOutputEvicted(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemUpstream()
+	wu := &WithUpstream{
+		Upstream: evictingUpstream{mem},
+		Local:    &DiskCache{Dir: t.TempDir()},
+	}
+	const data = "some output"
+	actionID, outputID := testActionID("a"), testOutput(data)
+	if _, err := wu.Put(ctx, actionID, outputID, int64(len(data)), bytes.NewReader([]byte(data))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if mem.putActions != 1 || mem.puts != 1 {
+		t.Errorf("got %d PutActions and %d Puts; want 1 of each", mem.putActions, mem.puts)
+	}
+	if got := string(mem.outputs[outputID]); got != data {
+		t.Errorf("upstream has output %q; want %q", got, data)
+	}
+}
+
+func TestPutSkipsExistingOutput(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemUpstream()
+	wu := &WithUpstream{
+		Upstream: mem,
+		Local:    &DiskCache{Dir: t.TempDir()},
+	}
+	const data = "shared output"
+	outputID := testOutput(data)
+	for _, a := range []string{"a", "b"} {
+		if _, err := wu.Put(ctx, testActionID(a), outputID, int64(len(data)), bytes.NewReader([]byte(data))); err != nil {
+			t.Fatalf("Put %s: %v", a, err)
+		}
+	}
+	if mem.puts != 1 || mem.putActions != 1 {
+		t.Errorf("got %d Puts and %d PutActions; want 1 of each", mem.puts, mem.putActions)
+	}
+}
+
+func TestGetBackfillsLocal(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemUpstream()
+	const data = "remote output"
+	actionID, outputID := testActionID("a"), testOutput(data)
+	mem.Put(ctx, actionID, outputID, int64(len(data)), bytes.NewReader([]byte(data)))
+
+	local := &DiskCache{Dir: t.TempDir()}
+	wu := &WithUpstream{Upstream: mem, Local: local}
+	gotOutput, diskPath, err := wu.Get(ctx, actionID)
+	if err != nil || gotOutput != outputID {
+		t.Fatalf("Get = %q, %v; want %q", gotOutput, err, outputID)
+	}
+	if b, err := os.ReadFile(diskPath); err != nil || string(b) != data {
+		t.Errorf("disk has %q, %v; want %q", b, err, data)
+	}
+	if gotOutput, _, _ := local.Get(ctx, actionID); gotOutput != outputID {
+		t.Errorf("local Get = %q; want %q", gotOutput, outputID)
+	}
+}
+
+// blockingUpstream is a memUpstream whose Puts wait for release to be
+// closed or their context to end.
+type blockingUpstream struct {
+	*memUpstream
+	release chan struct{}
+}
+
+func (b blockingUpstream) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	select {
+	case <-b.release:
+		return b.memUpstream.Put(ctx, actionID, outputID, size, body)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestAsyncPutsBounded(t *testing.T) {
+	mem := newMemUpstream()
+	up := blockingUpstream{mem, make(chan struct{})}
+	wu := &WithUpstream{
+		Upstream:     up,
+		Local:        &DiskCache{Dir: t.TempDir()},
+		AsyncPuts:    true,
+		MaxAsyncPuts: 1,
+	}
+	put := func(ctx context.Context, name string) error {
+		data := "output " + name
+		_, err := wu.Put(ctx, testActionID(name), testOutput(data), int64(len(data)), bytes.NewReader([]byte(data)))
+		return err
+	}
+	if err := put(context.Background(), "a"); err != nil {
+		t.Fatalf("Put a: %v", err)
+	}
+	// With a's write still in flight, b's is forwarded before Put returns.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := put(ctx, "b"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Put b = %v; want it to wait for the upstream and time out", err)
+	}
+	close(up.release)
+	wu.Wait()
+	if !mem.has(testActionID("a")) {
+		t.Errorf("background write of a didn't reach the upstream")
+	}
+}
+
+func TestAsyncPutTimeout(t *testing.T) {
+	up := blockingUpstream{newMemUpstream(), make(chan struct{})}
+	wu := &WithUpstream{
+		Upstream:        up,
+		Local:           &DiskCache{Dir: t.TempDir()},
+		AsyncPuts:       true,
+		AsyncPutTimeout: 20 * time.Millisecond,
+	}
+	const data = "output"
+	if _, err := wu.Put(context.Background(), testActionID("a"), testOutput(data), int64(len(data)), bytes.NewReader([]byte(data))); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	wu.Wait()
+	if got := wu.AsyncPutErrors.Load(); got != 1 {
+		t.Errorf("AsyncPutErrors = %d; want 1", got)
+	}
+}
+
+func TestGetInlineData(t *testing.T) {
+	ctx := context.Background()
+	const data = "inline output"
+	outputID := testOutput(data)
+	tests := []struct {
+		name           string
+		inline         []byte
+		wantGetOutputs int
+	}{
+		{"inline", []byte(data), 0},
+		{"no inline", nil, 1},
+		{"truncated inline", []byte(data[:4]), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mem := newMemUpstream()
+			actionID := testActionID("a")
+			mem.outputs[outputID] = []byte(data)
+			mem.actions[actionID] = &ActionValue{OutputID: outputID, Size: int64(len(data)), Data: tt.inline}
+			wu := &WithUpstream{Upstream: mem, Local: &DiskCache{Dir: t.TempDir()}}
+			gotOutput, diskPath, err := wu.Get(ctx, actionID)
+			if err != nil || gotOutput != outputID {
+				t.Fatalf("Get = %q, %v; want %q", gotOutput, err, outputID)
+			}
+			if b, err := os.ReadFile(diskPath); err != nil || string(b) != data {
+				t.Errorf("disk has %q, %v; want %q", b, err, data)
+			}
+			if mem.getOutputs != tt.wantGetOutputs {
+				t.Errorf("got %d GetOutputs; want %d", mem.getOutputs, tt.wantGetOutputs)
+			}
+		})
+	}
+}
+
+// slowUpstream is a memUpstream whose lookups wait for release to be
+// closed or their context to end.
+type slowUpstream struct {
+	*memUpstream
+	release    chan struct{}
+	getActions atomic.Int32
+}
+
+func (s *slowUpstream) GetAction(ctx context.Context, actionID string) (*ActionValue, error) {
+	s.getActions.Add(1)
+	select {
+	case <-s.release:
+		return s.memUpstream.GetAction(ctx, actionID)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestGetBounded(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemUpstream()
+	const data = "slow output"
+	actionID, outputID := testActionID("a"), testOutput(data)
+	mem.Put(ctx, actionID, outputID, int64(len(data)), bytes.NewReader([]byte(data)))
+	up := &slowUpstream{memUpstream: mem, release: make(chan struct{})}
+	local := &DiskCache{Dir: t.TempDir()}
+	wu := &WithUpstream{
+		Upstream:         up,
+		Local:            local,
+		GetActionTimeout: 20 * time.Millisecond,
+	}
+
+	if gotOutput, _, err := wu.Get(ctx, actionID); gotOutput != "" || err != nil {
+		t.Fatalf("Get of a slow action = %q, %v; want a miss", gotOutput, err)
+	}
+	if n := wu.BackgroundGets.Load(); n != 1 {
+		t.Errorf("BackgroundGets = %d; want 1", n)
+	}
+	// While the first is in the background, another Get doesn't start a
+	// second download.
+	if gotOutput, _, err := wu.Get(ctx, actionID); gotOutput != "" || err != nil {
+		t.Fatalf("second Get = %q, %v; want a miss", gotOutput, err)
+	}
+	if n := up.getActions.Load(); n != 1 {
+		t.Errorf("upstream got %d lookups; want 1", n)
+	}
+
+	close(up.release)
+	wu.Wait()
+	if gotOutput, _, _ := local.Get(ctx, actionID); gotOutput != outputID {
+		t.Errorf("after the background download, local Get = %q; want %q", gotOutput, outputID)
+	}
+	// Once it's done, a Get looks up the action again.
+	if gotOutput, _, err := wu.Get(ctx, testActionID("b")); gotOutput != "" || err != nil {
+		t.Errorf("Get of a missing action = %q, %v", gotOutput, err)
+	}
+	if n := up.getActions.Load(); n != 2 {
+		t.Errorf("upstream got %d lookups; want 2", n)
+	}
+}
+
+func TestGetBoundedBackgroundTimeout(t *testing.T) {
+	ctx := context.Background()
+	up := &slowUpstream{memUpstream: newMemUpstream(), release: make(chan struct{})}
+	wu := &WithUpstream{
+		Upstream:         up,
+		Local:            &DiskCache{Dir: t.TempDir()},
+		GetActionTimeout: 10 * time.Millisecond,
+	}
+	if gotOutput, _, err := wu.Get(ctx, testActionID("a")); gotOutput != "" || err != nil {
+		t.Fatalf("Get = %q, %v; want a miss", gotOutput, err)
+	}
+	// The lookup never returns by itself; the background deadline ends it.
+	done := make(chan struct{})
+	go func() {
+		wu.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("background Get wasn't canceled after %v", wu.backgroundTimeout(-1))
+	}
+}
+
+func TestUpstreamPolicy(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		policy    string
+		want      UpstreamPolicy
+		wantRead  bool
+		wantWrite bool
+	}{
+		{"", PolicyReadWrite, true, true},
+		{"rw", PolicyReadWrite, true, true},
+		{"read-only", PolicyReadOnly, true, false},
+		{"wo", PolicyWriteOnly, false, true},
+		{"disabled", PolicyDisabled, false, false},
+		{"off", PolicyDisabled, false, false},
+	}
+	for _, tt := range tests {
+		policy, err := ParseUpstreamPolicy(tt.policy)
+		if err != nil || policy != tt.want {
+			t.Errorf("ParseUpstreamPolicy(%q) = %v, %v; want %v", tt.policy, policy, err, tt.want)
+			continue
+		}
+		mem := newMemUpstream()
+		const data = "remote output"
+		remoteID := testActionID("remote")
+		mem.Put(ctx, remoteID, testOutput(data), int64(len(data)), bytes.NewReader([]byte(data)))
+		mem.puts = 0
+		wu := &WithUpstream{Upstream: mem, Local: &DiskCache{Dir: t.TempDir()}, Policy: policy}
+
+		gotOutput, _, err := wu.Get(ctx, remoteID)
+		if err != nil {
+			t.Fatalf("%v: Get: %v", policy, err)
+		}
+		if hit := gotOutput != ""; hit != tt.wantRead {
+			t.Errorf("%v: Get of a remote entry hit: %v; want %v", policy, hit, tt.wantRead)
+		}
+		if mem.getOutputs > 0 && !tt.wantRead {
+			t.Errorf("%v: got %d GetOutputs; want 0", policy, mem.getOutputs)
+		}
+
+		const local = "local output"
+		localID := testActionID("local")
+		if _, err := wu.Put(ctx, localID, testOutput(local), int64(len(local)), bytes.NewReader([]byte(local))); err != nil {
+			t.Fatalf("%v: Put: %v", policy, err)
+		}
+		if got := mem.has(localID); got != tt.wantWrite {
+			t.Errorf("%v: upstream has the Put action: %v; want %v", policy, got, tt.wantWrite)
+		}
+		if gotOutput, _, err := wu.Get(ctx, localID); err != nil || gotOutput != testOutput(local) {
+			t.Errorf("%v: local Get after Put = %q, %v; want a hit", policy, gotOutput, err)
+		}
+	}
+	if _, err := ParseUpstreamPolicy("sometimes"); err == nil {
+		t.Errorf("ParseUpstreamPolicy of an unknown policy succeeded")
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	ctx := context.Background()
+	mem := newMemUpstream()
+	wu := &WithUpstream{
+		Upstream:   mem,
+		Local:      &DiskCache{Dir: t.TempDir()},
+		PutMinSize: 4,
+		PutMaxSize: 8,
+	}
+	puts := []struct {
+		data    string
+		wantPut bool
+	}{
+		{"abc", false},       // below PutMinSize
+		{"abcd", true},       // at PutMinSize
+		{"abcdefgh", true},   // at PutMaxSize
+		{"abcdefghi", false}, // above PutMaxSize
+	}
+	for _, p := range puts {
+		actionID := testActionID(p.data)
+		if _, err := wu.Put(ctx, actionID, testOutput(p.data), int64(len(p.data)), bytes.NewReader([]byte(p.data))); err != nil {
+			t.Fatalf("Put %q: %v", p.data, err)
+		}
+		if got := mem.has(actionID); got != p.wantPut {
+			t.Errorf("Put %q: upstream has it: %v; want %v", p.data, got, p.wantPut)
+		}
+	}
+	if got := wu.SkippedPuts.Load(); got != 2 {
+		t.Errorf("SkippedPuts = %d; want 2", got)
+	}
+
+	gets := []struct {
+		data    string
+		wantHit bool
+	}{
+		{"abcdef", true},   // at GetMaxSize
+		{"abcdefg", false}, // above GetMaxSize
+	}
+	for _, g := range gets {
+		actionID := testActionID("remote " + g.data)
+		mem.Put(ctx, actionID, testOutput(g.data), int64(len(g.data)), bytes.NewReader([]byte(g.data)))
+		wu := &WithUpstream{Upstream: mem, Local: &DiskCache{Dir: t.TempDir()}, GetMaxSize: 6}
+		gotOutput, _, err := wu.Get(ctx, actionID)
+		if err != nil {
+			t.Fatalf("Get %q: %v", g.data, err)
+		}
+		if hit := gotOutput != ""; hit != g.wantHit {
+			t.Errorf("Get %q hit: %v; want %v", g.data, hit, g.wantHit)
+		}
+		wantSkipped := int64(0)
+		if !g.wantHit {
+			wantSkipped = 1
+		}
+		if got := wu.SkippedGets.Load(); got != wantSkipped {
+			t.Errorf("Get %q: SkippedGets = %d; want %d", g.data, got, wantSkipped)
+		}
+	}
+}
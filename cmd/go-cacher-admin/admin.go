@@ -0,0 +1,187 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The go-cacher-admin command inspects and removes entries of a
+// go-cacher-server through its /admin/ endpoints.
+//
+// Usage:
+//
+//	go-cacher-admin [flags] get <actionID>
+//	go-cacher-admin [flags] rm-action <actionID>...
+//	go-cacher-admin [flags] rm-output <outputID>...
+//	go-cacher-admin [flags] purge <RFC 3339 time | age like 720h>
+//	go-cacher-admin [flags] ls
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+var (
+	serverBase    = flag.String("server", "http://localhost:31364", "go-cacher-server base URL")
+	namespace     = flag.String("namespace", "", "optional server namespace; empty means the default namespace")
+	tokenFile     = flag.String("token-file", "", "optional file containing an admin bearer token; $"+tokenEnv+" takes precedence")
+	basicAuthFile = flag.String("basic-auth-file", "", "optional file containing admin \"user:password\"; $"+basicAuthEnv+" takes precedence")
+	timeout       = flag.Duration("timeout", time.Minute, "deadline for each request, except listing")
+)
+
+// Environment variables holding the admin credentials.
+const (
+	tokenEnv     = "GOCACHER_ADMIN_TOKEN"
+	basicAuthEnv = "GOCACHER_ADMIN_BASIC_AUTH"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: go-cacher-admin [flags] <command> [args]
+
+commands:
+  get <actionID>            print an action's metadata
+  rm-action <actionID>...   delete actions
+  rm-output <outputID>...   delete outputs
+  purge <time|age>          delete entries stored before an RFC 3339 time or longer ago than a duration
+  ls                        list all actions, one JSON object per line
+
+flags:
+`)
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+type client struct {
+	base      string
+	token     string
+	user, pwd string
+}
+
+func main() {
+	log.SetFlags(0)
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+	}
+	c := &client{base: strings.TrimSuffix(*serverBase, "/")}
+	if *namespace != "" {
+		c.base += "/ns/" + url.PathEscape(*namespace)
+	}
+	var err error
+	if c.token, err = cachers.LoadSecret(tokenEnv, *tokenFile); err != nil {
+		log.Fatal(err)
+	}
+	if c.user, c.pwd, err = cachers.LoadBasicAuth(basicAuthEnv, *basicAuthFile); err != nil {
+		log.Fatal(err)
+	}
+
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+	switch cmd {
+	case "get":
+		if len(args) != 1 {
+			usage()
+		}
+		err = c.call("GET", "/admin/action/"+args[0], os.Stdout)
+	case "rm-action", "rm-output":
+		if len(args) == 0 {
+			usage()
+		}
+		kind := strings.TrimPrefix(cmd, "rm-")
+		for _, id := range args {
+			if err = c.call("DELETE", "/admin/"+kind+"/"+id, nil); err != nil {
+				break
+			}
+		}
+	case "purge":
+		if len(args) != 1 {
+			usage()
+		}
+		var before time.Time
+		before, err = parseBefore(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = c.call("POST", "/admin/purge?before="+url.QueryEscape(before.Format(time.RFC3339Nano)), os.Stdout)
+	case "ls":
+		if len(args) != 0 {
+			usage()
+		}
+		*timeout = 0
+		err = c.call("GET", "/admin/entries", os.Stdout)
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// parseBefore parses s as an RFC 3339 time or as an age.
+func parseBefore(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 time nor a duration", s)
+	}
+	return time.Now().Add(-d), nil
+}
+
+// call makes a request to the server and copies the response body to out,
+// if non-nil.
+func (c *client) call(method, path string, out io.Writer) error {
+	ctx := context.Background()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.base+path, nil)
+	if err != nil {
+		return err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	} else if c.user != "" {
+		req.SetBasicAuth(c.user, c.pwd)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 1<<10))
+		return fmt.Errorf("%s %s: %v: %s", method, path, res.Status, strings.TrimSpace(string(body)))
+	}
+	if out == nil {
+		return nil
+	}
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		// Pretty-print single objects.
+		body, err := io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := json.Indent(&buf, body, "", "\t"); err != nil {
+			return err
+		}
+		_, err = buf.WriteTo(out)
+		return err
+	}
+	_, err = io.Copy(out, res.Body)
+	return err
+}
@@ -0,0 +1,126 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+// handleAdmin serves the /admin/ endpoints for inspecting and removing
+// entries of ns. It doesn't consult ns's parents.
+func (s *server) handleAdmin(w http.ResponseWriter, r *http.Request, ns *namespace) {
+	switch {
+	case r.URL.Path == "/admin/entries" && r.Method == "GET":
+		s.handleAdminEntries(w, r, ns)
+	case r.URL.Path == "/admin/purge" && r.Method == "POST":
+		s.handleAdminPurge(w, r, ns)
+	case strings.HasPrefix(r.URL.Path, "/admin/action/"):
+		actionID, ok := getHexSuffix(r, "/admin/action/")
+		if !ok {
+			http.Error(w, "bad action ID", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case "GET":
+			e, err := ns.disk.Entry(actionID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if e == nil {
+				http.Error(w, "not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(e)
+		case "DELETE":
+			err := ns.disk.DeleteAction(actionID)
+			s.adminDeleted(w, r, err)
+		default:
+			http.Error(w, "bad method", http.StatusMethodNotAllowed)
+		}
+	case strings.HasPrefix(r.URL.Path, "/admin/output/") && r.Method == "DELETE":
+		outputID, ok := getHexSuffix(r, "/admin/output/")
+		if !ok {
+			http.Error(w, "bad output ID", http.StatusBadRequest)
+			return
+		}
+		freed, err := ns.disk.DeleteOutput(outputID)
+		ns.used.Add(-freed)
+		s.adminDeleted(w, r, err)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+func (s *server) adminDeleted(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "not found", http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		log.Printf("admin: %s %s", r.Method, r.RequestURI)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *server) handleAdminPurge(w http.ResponseWriter, r *http.Request, ns *namespace) {
+	before, err := time.Parse(time.RFC3339, r.URL.Query().Get("before"))
+	if err != nil {
+		http.Error(w, "bad or missing before parameter; want an RFC 3339 time", http.StatusBadRequest)
+		return
+	}
+	st, err := ns.disk.Purge(before)
+	ns.used.Add(-st.Bytes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("admin: purged entries before %v: %d actions, %d outputs, %d bytes", before, st.Actions, st.Outputs, st.Bytes)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(st)
+}
+
+// handleAdminEntries streams ns's actions as JSON lines.
+func (s *server) handleAdminEntries(w http.ResponseWriter, r *http.Request, ns *namespace) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	flusher, _ := w.(http.Flusher)
+	n := 0
+	err := ns.disk.WalkEntries(func(e *cachers.DiskEntry) error {
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+		if n++; n%1000 == 0 {
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		// Too late for an error status; the client sees a truncated list.
+		log.Printf("admin: listing entries: %v", err)
+		return
+	}
+	bw.Flush()
+}
@@ -0,0 +1,230 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// scopes is a set of permissions granted to a client.
+type scopes uint8
+
+const (
+	scopeRead scopes = 1 << iota
+	scopeWrite
+	scopeAdmin // the /admin/ endpoints
+)
+
+func parseScopes(s string) (scopes, error) {
+	var sc scopes
+	for _, f := range strings.Split(s, ",") {
+		switch strings.TrimSpace(f) {
+		case "":
+		case "read":
+			sc |= scopeRead
+		case "write":
+			sc |= scopeWrite
+		case "admin":
+			sc |= scopeAdmin
+		default:
+			return 0, fmt.Errorf("unknown scope %q", f)
+		}
+	}
+	return sc, nil
+}
+
+// identity is who a request was authenticated as.
+type identity struct {
+	name   string // for logs; "anonymous" if no credentials were presented
+	scopes scopes
+}
+
+// credential is a secret from a token or basic auth file.
+type credential struct {
+	name   string
+	secret string
+	scopes scopes
+}
+
+// authenticator checks the credentials of incoming requests.
+// The zero value lets everyone read and write, but not use the /admin/
+// endpoints, which need a credential granting the admin scope.
+type authenticator struct {
+	tokens     []credential // bearer tokens
+	users      []credential // basic auth; secret is the password
+	certScopes scopes       // for clients with a verified TLS certificate
+	anonymous  scopes       // for requests without credentials
+
+	configured bool // whether any credential flags were set
+}
+
+// configure sets up a from the command-line flags. Each credential flag
+// that's set turns authentication on, and must yield some credentials, so
+// that a mistake doesn't leave the cache open to everyone.
+func (a *authenticator) configure() error {
+	var err error
+	if a.anonymous, err = parseScopes(*anonymousScopes); err != nil {
+		return fmt.Errorf("-anonymous-scopes: %v", err)
+	}
+	if a.anonymous&scopeAdmin != 0 {
+		return fmt.Errorf("-anonymous-scopes can't include admin")
+	}
+	if *tokenFile != "" {
+		a.configured = true
+		if err := a.loadTokens(*tokenFile); err != nil {
+			return err
+		}
+		if len(a.tokens) == 0 {
+			return fmt.Errorf("-token-file %s has no tokens", *tokenFile)
+		}
+	}
+	if *basicAuthFile != "" {
+		a.configured = true
+		if err := a.loadUsers(*basicAuthFile); err != nil {
+			return err
+		}
+		if len(a.users) == 0 {
+			return fmt.Errorf("-basic-auth-file %s has no users", *basicAuthFile)
+		}
+	}
+	if *tlsClientCA != "" {
+		a.configured = true
+		if a.certScopes, err = parseScopes(*clientCertScopes); err != nil {
+			return fmt.Errorf("-client-cert-scopes: %v", err)
+		}
+		if a.certScopes == 0 {
+			return fmt.Errorf("-tls-client-ca needs -client-cert-scopes")
+		}
+	}
+	return nil
+}
+
+// loadTokens reads a bearer token file. Each non-empty, non-comment line is
+// "<scopes> <token> [name]", where scopes is a comma-separated list of
+// read, write and admin.
+func (a *authenticator) loadTokens(file string) error {
+	return readCredentialFile(file, func(sc scopes, fields []string) error {
+		if len(fields) < 1 || len(fields) > 2 {
+			return fmt.Errorf("want \"<scopes> <token> [name]\"")
+		}
+		name := "token"
+		if len(fields) == 2 {
+			name = fields[1]
+		}
+		a.tokens = append(a.tokens, credential{name: name, secret: fields[0], scopes: sc})
+		return nil
+	})
+}
+
+// loadUsers reads a basic auth file. Each non-empty, non-comment line is
+// "<scopes> <user>:<password>".
+func (a *authenticator) loadUsers(file string) error {
+	return readCredentialFile(file, func(sc scopes, fields []string) error {
+		user, pass, ok := strings.Cut(strings.Join(fields, " "), ":")
+		if !ok || user == "" {
+			return fmt.Errorf("want \"<scopes> <user>:<password>\"")
+		}
+		a.users = append(a.users, credential{name: user, secret: pass, scopes: sc})
+		return nil
+	})
+}
+
+func readCredentialFile(file string, add func(scopes, []string) error) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bs := bufio.NewScanner(f)
+	for n := 1; bs.Scan(); n++ {
+		line := strings.TrimSpace(bs.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		sc, err := parseScopes(fields[0])
+		if err == nil {
+			err = add(sc, fields[1:])
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", file, n, err)
+		}
+	}
+	return bs.Err()
+}
+
+// authenticate returns the identity of r. If r presents credentials that
+// don't match, ok is false.
+func (a *authenticator) authenticate(r *http.Request) (id identity, ok bool) {
+	if !a.configured {
+		return identity{name: "anonymous", scopes: scopeRead | scopeWrite}, true
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && a.certScopes != 0 {
+		cert := r.TLS.VerifiedChains[0][0]
+		return identity{name: "cert:" + cert.Subject.CommonName, scopes: a.certScopes}, true
+	}
+	if user, pass, isBasic := r.BasicAuth(); isBasic {
+		for _, c := range a.users {
+			if secretEqual(c.name, user) && secretEqual(c.secret, pass) {
+				return identity{name: "user:" + c.name, scopes: c.scopes}, true
+			}
+		}
+		return identity{}, false
+	}
+	if token, isBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); isBearer {
+		for _, c := range a.tokens {
+			if secretEqual(c.secret, token) {
+				return identity{name: "token:" + c.name, scopes: c.scopes}, true
+			}
+		}
+		return identity{}, false
+	}
+	return identity{name: "anonymous", scopes: a.anonymous}, true
+}
+
+// adminConfigured reports whether any credential grants the admin scope.
+func (a *authenticator) adminConfigured() bool {
+	if a.certScopes&scopeAdmin != 0 {
+		return true
+	}
+	for _, creds := range [][]credential{a.tokens, a.users} {
+		for _, c := range creds {
+			if c.scopes&scopeAdmin != 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func secretEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// checkAuth authenticates r and checks that it's allowed the scope need.
+// If not, it writes an error response and returns false.
+func (s *server) checkAuth(w http.ResponseWriter, r *http.Request, need scopes) (identity, bool) {
+	id, ok := s.auth.authenticate(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="go-cacher-server"`)
+		http.Error(w, "bad credentials", http.StatusUnauthorized)
+		return id, false
+	}
+	if id.scopes&need != need {
+		if id.name == "anonymous" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="go-cacher-server"`)
+			http.Error(w, "credentials required", http.StatusUnauthorized)
+			return id, false
+		}
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return id, false
+	}
+	return id, true
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// setFlag sets a flag for the duration of the test.
+func setFlag[T any](t *testing.T, p *T, v T) {
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+func writeFile(t *testing.T, content string) string {
+	file := filepath.Join(t.TempDir(), "creds")
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestAuthConfigureFailsClosed(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T)
+		wantErr bool
+	}{
+		{"nothing", func(t *testing.T) {}, false},
+		{"empty token file", func(t *testing.T) {
+			setFlag(t, tokenFile, writeFile(t, ""))
+		}, true},
+		{"comment-only token file", func(t *testing.T) {
+			setFlag(t, tokenFile, writeFile(t, "# read,write secret\n\n"))
+		}, true},
+		{"token file", func(t *testing.T) {
+			setFlag(t, tokenFile, writeFile(t, "read,write secret ci\n"))
+		}, false},
+		{"empty basic auth file", func(t *testing.T) {
+			setFlag(t, basicAuthFile, writeFile(t, "\n"))
+		}, true},
+		{"client CA without scopes", func(t *testing.T) {
+			setFlag(t, tlsClientCA, "ca.pem")
+			setFlag(t, clientCertScopes, "")
+		}, true},
+		{"client CA", func(t *testing.T) {
+			setFlag(t, tlsClientCA, "ca.pem")
+		}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup(t)
+			var a authenticator
+			err := a.configure()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("configure error = %v; want error %v", err, tt.wantErr)
+			}
+			if err == nil && !a.configured && (*tokenFile != "" || *tlsClientCA != "") {
+				t.Errorf("credential flags set but authentication not configured")
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	setFlag(t, tokenFile, writeFile(t, "read reader-secret reader\nread,write writer-secret writer\n"))
+	setFlag(t, basicAuthFile, writeFile(t, "read alice:pw\n"))
+	var a authenticator
+	if err := a.configure(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		authHeader string
+		user, pass string
+		wantOK     bool
+		wantScopes scopes
+	}{
+		{name: "anonymous", wantOK: true, wantScopes: 0},
+		{name: "reader", authHeader: "Bearer reader-secret", wantOK: true, wantScopes: scopeRead},
+		{name: "writer", authHeader: "Bearer writer-secret", wantOK: true, wantScopes: scopeRead | scopeWrite},
+		{name: "bad token", authHeader: "Bearer nope", wantOK: false},
+		{name: "basic", user: "alice", pass: "pw", wantOK: true, wantScopes: scopeRead},
+		{name: "bad password", user: "alice", pass: "x", wantOK: false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/action/abcd", nil)
+		if tt.authHeader != "" {
+			r.Header.Set("Authorization", tt.authHeader)
+		}
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.pass)
+		}
+		id, ok := a.authenticate(r)
+		if ok != tt.wantOK || ok && id.scopes != tt.wantScopes {
+			t.Errorf("%s: authenticate = %+v, %v; want scopes %v, %v", tt.name, id, ok, tt.wantScopes, tt.wantOK)
+		}
+	}
+}
+
+func TestAdminNeedsAdminCredential(t *testing.T) {
+	tests := []struct {
+		name      string
+		tokens    string
+		anonymous string
+		creds     []string
+		want      int
+	}{
+		{name: "no auth", want: http.StatusForbidden},
+		{name: "no admin token", tokens: "read,write rw-secret\n", creds: []string{"Authorization", "Bearer rw-secret"}, want: http.StatusForbidden},
+		{name: "anonymous", tokens: "admin admin-secret\n", anonymous: "read,write", want: http.StatusUnauthorized},
+		{name: "non-admin token", tokens: "admin admin-secret\nread,write rw-secret\n", creds: []string{"Authorization", "Bearer rw-secret"}, want: http.StatusForbidden},
+		{name: "admin token", tokens: "admin admin-secret\n", creds: []string{"Authorization", "Bearer admin-secret"}, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.tokens != "" {
+				setFlag(t, tokenFile, writeFile(t, tt.tokens))
+			}
+			setFlag(t, anonymousScopes, tt.anonymous)
+			srv := newTestServer(t)
+			if got := do(t, srv, "GET", "/admin/entries", "", tt.creds...).StatusCode; got != tt.want {
+				t.Errorf("GET /admin/entries: %d; want %d", got, tt.want)
+			}
+			if got := do(t, srv, "POST", "/admin/purge?before=2100-01-01T00:00:00Z", "", tt.creds...).StatusCode; got/100 == 2 && tt.want != http.StatusOK {
+				t.Errorf("POST /admin/purge: %d; want it refused", got)
+			}
+		})
+	}
+}
+
+func TestAnonymousAdminRejected(t *testing.T) {
+	setFlag(t, anonymousScopes, "read,admin")
+	var a authenticator
+	if err := a.configure(); err == nil {
+		t.Errorf("configure with -anonymous-scopes=read,admin succeeded")
+	}
+}
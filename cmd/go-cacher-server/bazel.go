@@ -0,0 +1,39 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// bazelPrefixes maps the path prefixes of the Bazel HTTP remote cache
+// protocol to their equivalents here. Both use hex SHA-256 digests, and
+// go-cacher stores ActionValue JSON under /ac/, so no translation of the
+// bodies is needed.
+var bazelPrefixes = map[string]string{
+	"/ac/":  "/action/",
+	"/cas/": "/output/",
+}
+
+// bazelAlias returns r with a Bazel /ac/ or /cas/ path rewritten to the
+// corresponding /action/ or /output/ path, or r itself if it has neither.
+func bazelAlias(r *http.Request) *http.Request {
+	for from, to := range bazelPrefixes {
+		rest, ok := strings.CutPrefix(r.URL.Path, from)
+		if !ok {
+			continue
+		}
+		r2 := new(http.Request)
+		*r2 = *r
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = to + rest
+		r2.URL.RawPath = ""
+		return r2
+	}
+	return r
+}
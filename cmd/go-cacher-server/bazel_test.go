@@ -0,0 +1,70 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+func TestBazelPaths(t *testing.T) {
+	ctx := context.Background()
+	srv := newTestServer(t)
+	srv.bazelPaths = true
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	b := &cachers.BazelRemote{BaseURL: ts.URL}
+
+	const data = "output written over the Bazel protocol"
+	actionID, outputID := sha256Hex("action bazel"), sha256Hex(data)
+	if _, err := b.GetAction(ctx, actionID); !errors.Is(err, cachers.ErrNotFound) {
+		t.Fatalf("GetAction before Put = %v; want not found", err)
+	}
+	if err := b.Put(ctx, actionID, outputID, int64(len(data)), strings.NewReader(data)); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	av, err := b.GetAction(ctx, actionID)
+	if err != nil || av.OutputID != outputID || av.Size != int64(len(data)) {
+		t.Fatalf("GetAction = %+v, %v", av, err)
+	}
+	body, err := b.GetOutput(ctx, outputID)
+	if err != nil {
+		t.Fatalf("GetOutput: %v", err)
+	}
+	got, err := io.ReadAll(body)
+	body.Close()
+	if err != nil || string(got) != data {
+		t.Errorf("GetOutput body = %q, %v; want %q", got, err, data)
+	}
+	if has, err := b.HasOutput(ctx, outputID); !has || err != nil {
+		t.Errorf("HasOutput = %v, %v; want true, nil", has, err)
+	}
+	other := sha256Hex("action bazel 2")
+	if err := b.PutAction(ctx, other, outputID, int64(len(data))); err != nil {
+		t.Fatalf("PutAction: %v", err)
+	}
+
+	// The entries are the same as those under the native paths.
+	if res := do(t, srv, "GET", "/output/"+outputID, ""); res.StatusCode != http.StatusOK {
+		t.Errorf("GET /output/ of a Bazel upload: %s", res.Status)
+	}
+	if res := do(t, srv, "GET", "/action/"+other, ""); res.StatusCode != http.StatusOK {
+		t.Errorf("GET /action/ of a Bazel AC entry: %s", res.Status)
+	}
+
+	// Without -bazel-paths, the Bazel paths aren't served.
+	ts.Close()
+	srv.bazelPaths = false
+	if res := do(t, srv, "GET", "/ac/"+actionID, ""); res.StatusCode == http.StatusOK {
+		t.Errorf("GET /ac/ without -bazel-paths: %s; want an error", res.Status)
+	}
+}
@@ -9,26 +9,114 @@ Protocol:
 
 GET /action/<actionID-hex>
 {"outputID":"$outputID-hex","size":1234}
+ETag: "$outputID-hex"
+Outputs of up to -inline-max-size bytes are included as "data", base64, so
+clients needn't fetch them separately.
 
 GET /output/<outputID-hex>
 200 of those bytes with Content-Length or 404
+ETag: "$outputID-hex"
+Cache-Control: public, max-age=31536000, immutable
+(private rather than public if credentials or namespace read lists are
+configured, so shared caches don't serve it to others)
+
+POST /actions:batchGet
+{"actionIDs":["$actionID-hex",...]}
+{"actions":{"$actionID-hex":{"outputID":"$outputID-hex","size":1234},...}}
+Actions that aren't found are omitted.
+
+Clients may send Accept-Encoding: gzip or zstd for outputs, and PUT bodies
+with Content-Encoding: gzip or zstd. Compressed bodies carry the uncompressed
+size in a Go-Cache-Size header, which output responses always include.
+
+HEAD of /action/ and /output/ is also supported, as is If-None-Match. Outputs never change
+once written, so a caching proxy may keep them forever; actions may be
+overwritten, so proxies must revalidate them.
 
 PUT /<actionID>/<outputID>
 Content-Length: 1234
 <bytes>
+400 if the bytes don't match an optional Content-Digest header (sha-256 or
+sha-512) or, with -verify-outputs, if their SHA-256 isn't the output ID.
+
+PUT /output/<outputID-hex>
+Content-Length: 1234
+<bytes>
+Stores an output without an action, for a later PUT /action/. Otherwise
+like the above.
+
+PUT /action/<actionID-hex>
+{"outputID":"$outputID-hex","size":1234}
+204, or 404 if that output isn't already stored
+
+With -bazel-paths, /ac/ and /cas/ are also accepted in place of /action/
+and /output/, so that go-cacher's -remote=bazel, which speaks the Bazel
+HTTP remote cache protocol, can use this server.
+
+If any of -token-file, -basic-auth-file or -tls-client-ca are set, requests
+must authenticate with a bearer token, basic auth or a client certificate.
+PUT needs the write scope; everything else needs the read scope.
+
+All of the above may be prefixed with /ns/<name> to use a namespace
+configured in -namespaces-file, such as /ns/pr/action/<actionID-hex>.
+Namespaces have separate entries, access lists and quotas, and may read
+through to a parent namespace. Unprefixed paths use the default namespace.
+A PUT that would exceed a namespace's quota fails with 507; entries from
+an origin that would exceed it are misses.
+
+The /admin/ endpoints need the admin scope, which bypasses namespace
+access lists. Only tokens, users and client certificates can be granted it,
+so without any of those configured with it, they fail with 403:
+
+GET /admin/action/<actionID-hex>
+{"actionID":"...","outputID":"...","size":1234,"time":"...","uploader":"token:ci"}
+
+DELETE /admin/action/<actionID-hex>
+DELETE /admin/output/<outputID-hex>
+204, or 404 if it isn't stored
+
+POST /admin/purge?before=<RFC 3339 time>
+{"actions":12,"outputs":10,"bytes":123456}
+Removes actions stored before the time, and outputs older than it that no
+remaining action refers to.
+
+GET /admin/entries
+One JSON action entry per line, as for /admin/action/, streamed.
+
+With -cache-server or -remote, the server is a pull-through proxy: misses
+are fetched from that origin and stored locally, and writes are forwarded
+to it, before replying or in the background as -forward-puts says. A
+HEAD of /output/ only asks the origin whether it has the output, so its
+response has no Content-Length.
+
+GET /healthz and /readyz need no credentials. /healthz fails if the cache
+directory isn't writable; /readyz also fails while shutting down, for
+-drain-delay before the server stops accepting connections. If free space
+drops below -min-free-space the server turns read-only, rejecting PUTs
+with 507, and /readyz says so.
+
+Requests over the -put-rate, -get-rate or -max-concurrent-uploads limits
+get 429 with a Retry-After header. PUTs over -max-object-size get 413.
+
+GET /metrics returns Prometheus metrics, unless -metrics-listen moves it to
+a separate admin address.
 
 */
 package main
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/bradfitz/go-tool-cache/cachers"
@@ -37,8 +125,41 @@ import (
 var (
 	dir     = flag.String("cache-dir", "", "cache directory")
 	verbose = flag.Bool("verbose", false, "be verbose")
-	listen  = flag.String("listen", ":31364", "listen address")
+	listen  = flag.String("listen", ":31364", "listen address: host:port, or unix:<path> for a unix domain socket")
+	useH2C  = flag.Bool("h2c", false, "also accept cleartext HTTP/2 (h2c) with prior knowledge, for HTTPRemote.PreferHTTP2 clients on trusted networks")
 	latency = flag.Duration("inject-latency", 0, "the additional latency to add to all requests (for testing)")
+
+	compressAtRest    = flag.Bool("compress-at-rest", false, "store new outputs zstd-compressed on disk; they're decompressed on the fly for clients that don't accept zstd")
+	compressResponses = flag.Bool("compress-responses", false, "compress outputs stored uncompressed on the fly for clients that accept gzip or zstd; note that Go's HTTP client asks for gzip by default, which old HTTPRemote versions can't handle")
+
+	tokenFile        = flag.String("token-file", "", "optional file of bearer tokens, one \"<scopes> <token> [name]\" per line; scopes is a comma-separated list of read, write and admin")
+	basicAuthFile    = flag.String("basic-auth-file", "", "optional file of basic auth users, one \"<scopes> <user>:<password>\" per line")
+	anonymousScopes  = flag.String("anonymous-scopes", "", "scopes granted to requests without credentials, when any credentials are configured")
+	tlsCert          = flag.String("tls-cert", "", "optional TLS certificate file; if set, the server speaks HTTPS. The certificate and key are reloaded on SIGHUP.")
+	tlsKey           = flag.String("tls-key", "", "TLS private key file for -tls-cert")
+	tlsClientCA      = flag.String("tls-client-ca", "", "optional CA bundle for verifying TLS client certificates (mTLS)")
+	clientCertScopes = flag.String("client-cert-scopes", "read,write", "scopes granted to clients presenting a certificate signed by -tls-client-ca")
+
+	metricsListen = flag.String("metrics-listen", "", "optional separate address, such as localhost:9090, to serve /metrics on without authentication; if empty, /metrics is served on -listen and needs the read scope")
+
+	verifyOutputs = flag.Bool("verify-outputs", false, "reject uploads whose SHA-256 doesn't match their output ID, as cmd/go's output IDs are")
+
+	drainTimeout = flag.Duration("drain-timeout", 30*time.Second, "on SIGINT or SIGTERM, how long to wait for requests in progress before exiting")
+	drainDelay   = flag.Duration("drain-delay", 5*time.Second, "on SIGINT or SIGTERM, how long to keep accepting requests after /readyz starts failing, so load balancers stop sending new ones first")
+	minFreeSpace = flag.Int64("min-free-space", 0, "if non-zero, switch to read-only mode, rejecting PUTs with 507, while the cache directory's file system has less than this many bytes free")
+
+	maxObjectSize = flag.Int64("max-object-size", 0, "largest output to accept, in bytes; larger PUTs get 413. 0 means no limit.")
+	putRate       = flag.Float64("put-rate", 0, "PUTs per second allowed for each identity, or client IP for anonymous requests; more get 429. 0 means no limit.")
+	putBurst      = flag.Int("put-burst", 0, "PUTs allowed in a burst above -put-rate; defaults to the rate")
+	getRate       = flag.Float64("get-rate", 0, "GETs, HEADs and batch lookups per second allowed for each identity or client IP; 0 means no limit")
+	getBurst      = flag.Int("get-burst", 0, "reads allowed in a burst above -get-rate; defaults to the rate")
+	maxUploads    = flag.Int("max-concurrent-uploads", 0, "uploads to handle at once; more get 429. 0 means no limit.")
+
+	inlineMaxSize = flag.Int64("inline-max-size", 1024, "outputs of up to this many bytes are included, base64, in action lookup responses, saving clients a request; 0 disables inlining")
+
+	bazelPaths = flag.Bool("bazel-paths", false, "also serve the Bazel HTTP remote cache URL scheme, /ac/<actionID> and /cas/<outputID>, as aliases of /action/ and /output/")
+
+	namespacesFile = flag.String("namespaces-file", "", "optional JSON file mapping namespace names to {\"read\":[...],\"write\":[...],\"parent\":\"...\",\"quotaBytes\":N}; the empty name configures the default namespace")
 )
 
 func main() {
@@ -52,44 +173,170 @@ func main() {
 		log.Printf("Defaulting to cache dir %v ...", d)
 		*dir = d
 	}
-	if err := os.MkdirAll(*dir, 0755); err != nil {
+	srv := &server{
+		verbose:           *verbose,
+		latency:           *latency,
+		compressResponses: *compressResponses,
+		metrics:           newMetrics(),
+		verifyOutputs:     *verifyOutputs,
+		maxObjectSize:     *maxObjectSize,
+		inlineMaxSize:     *inlineMaxSize,
+		bazelPaths:        *bazelPaths,
+		putLimiter:        newRateLimiter(*putRate, *putBurst),
+		getLimiter:        newRateLimiter(*getRate, *getBurst),
+	}
+	if *maxUploads > 0 {
+		srv.uploads = make(chan struct{}, *maxUploads)
+	}
+	if err := srv.configureNamespaces(); err != nil {
+		log.Fatal(err)
+	}
+	if err := srv.auth.configure(); err != nil {
 		log.Fatal(err)
 	}
 
-	srv := &server{
-		cache:  &cachers.DiskCache{Dir: *dir, Verbose: *verbose},
-		verbose: *verbose,
-		latency: *latency,
+	if *metricsListen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", srv.metrics)
+		go func() {
+			log.Fatal(http.ListenAndServe(*metricsListen, mux))
+		}()
 	}
+	hs, err := newHTTPServer(srv.metrics.instrument(srv))
+	if err != nil {
+		log.Fatal(err)
+	}
+	go srv.watchDisk()
+	go func() {
+		if err := serve(hs, *listen); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+	srv.shutdownOnSignal(hs)
+}
 
-	log.Fatal(http.ListenAndServe(*listen, srv))
+// store is what the server needs from its cache.
+type store interface {
+	cachers.Cache
+	cachers.LocalOutputStore
 }
 
+var (
+	_ store = (*cachers.DiskCache)(nil)
+	_ store = (*cachers.WithUpstream)(nil)
+)
+
 type server struct {
-	cache cachers.Cache
+	root       *namespace            // the default namespace
+	namespaces map[string]*namespace // by name; excludes root
+	auth       authenticator
+	metrics    *metrics
 
-	verbose bool
-	latency time.Duration
+	verbose           bool
+	latency           time.Duration
+	compressResponses bool
+	verifyOutputs     bool
+	maxObjectSize     int64
+	inlineMaxSize     int64
+	bazelPaths        bool
+	putLimiter        *rateLimiter  // nil if unlimited
+	getLimiter        *rateLimiter  // nil if unlimited
+	uploads           chan struct{} // semaphore for uploads; nil if unlimited
+
+	readOnly atomic.Bool  // whether the disk is nearly full; see updateReadOnly
+	draining atomic.Bool  // whether the server is shutting down
+	inflight atomic.Int64 // requests being served; see shutdown
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.inflight.Add(1)
+	defer s.inflight.Add(-1)
 	time.Sleep(s.latency)
 	if s.verbose {
 		log.Printf("%s %s", r.Method, r.RequestURI)
 	}
+	ns, r := s.splitNamespace(r)
+	if ns == nil {
+		http.Error(w, "unknown namespace", http.StatusNotFound)
+		return
+	}
+	if s.bazelPaths {
+		r = bazelAlias(r)
+	}
+	if ns == s.root {
+		switch r.URL.Path {
+		case "/healthz":
+			s.handleHealthz(w, r)
+			return
+		case "/readyz":
+			s.handleReadyz(w, r)
+			return
+		}
+	}
+	if r.URL.Path != "/" {
+		need := scopeRead
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/admin/"):
+			if !s.auth.adminConfigured() {
+				http.Error(w, "admin endpoints need a credential with the admin scope", http.StatusForbidden)
+				return
+			}
+			need = scopeAdmin
+		case r.Method == "PUT":
+			need = scopeWrite
+		}
+		id, ok := s.checkAuth(w, r, need)
+		if ok && !ns.allowed(id, need) {
+			http.Error(w, "forbidden in namespace", http.StatusForbidden)
+			ok = false
+		}
+		if !ok {
+			if s.verbose {
+				log.Printf("%s %s denied for %s", r.Method, r.RequestURI, id.name)
+			}
+			return
+		}
+		if need != scopeAdmin && !s.checkRate(w, r, id) {
+			if s.verbose {
+				log.Printf("%s %s rate limited for %s", r.Method, r.RequestURI, clientKey(r, id))
+			}
+			return
+		}
+		r = r.WithContext(cachers.ContextWithUploader(r.Context(), id.name))
+	}
+	if strings.HasPrefix(r.URL.Path, "/admin/") {
+		s.handleAdmin(w, r, ns)
+		return
+	}
 	if r.Method == "PUT" {
-		s.handlePut(w, r)
+		if s.readOnly.Load() {
+			http.Error(w, "read-only: low disk space", http.StatusInsufficientStorage)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/action/") {
+			s.handlePutAction(w, r, ns)
+			return
+		}
+		s.handlePut(w, r, ns)
 		return
 	}
-	if r.Method != "GET" {
+	if r.Method == "POST" && r.URL.Path == "/actions:batchGet" {
+		s.handleBatchGetActions(w, r, ns)
+		return
+	}
+	if r.URL.Path == "/metrics" && ns == s.root && *metricsListen == "" {
+		s.metrics.ServeHTTP(w, r)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
 		http.Error(w, "bad method", http.StatusBadRequest)
 		return
 	}
 	switch {
 	case strings.HasPrefix(r.URL.Path, "/action/"):
-		s.handleGetAction(w, r)
+		s.handleGetAction(w, r, ns)
 	case strings.HasPrefix(r.URL.Path, "/output/"):
-		s.handleGetOutput(w, r)
+		s.handleGetOutput(w, r, ns)
 	case r.URL.Path == "/":
 		io.WriteString(w, "hi")
 	default:
@@ -98,7 +345,7 @@ func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func getHexSuffix(r *http.Request, prefix string) (hexSuffix string, ok bool) {
-	hexSuffix, _ = strings.CutPrefix(r.RequestURI, prefix)
+	hexSuffix, _ = strings.CutPrefix(r.URL.Path, prefix)
 	if !validHex(hexSuffix) {
 		return "", false
 	}
@@ -119,71 +366,269 @@ func validHex(x string) bool {
 	return true
 }
 
-func (s *server) handleGetAction(w http.ResponseWriter, r *http.Request) {
+func (s *server) handleGetAction(w http.ResponseWriter, r *http.Request, ns *namespace) {
 	actionID, ok := getHexSuffix(r, "/action/")
 	if !ok {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
 
-	ctx := r.Context()
-	outputID, diskPath, err := s.cache.Get(ctx, actionID)
+	av, err := ns.lookupAction(r.Context(), actionID, s.inlineMaxSize)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	if outputID == "" {
-		http.Error(w, "not found ()", http.StatusNotFound)
+	s.metrics.lookup("action", av != nil)
+	if av == nil {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	etag := `"` + av.OutputID + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", s.cacheControl("no-cache"))
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
-	fi, err := os.Stat(diskPath)
+	avj, err := json.Marshal(av)
 	if err != nil {
-		if os.IsNotExist(err) {
-			http.Error(w, "not found (post-stat)", http.StatusNotFound)
-			return
-		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	avj = append(avj, '\n')
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(&cachers.ActionValue{
-		OutputID: outputID,
-		Size:     fi.Size(),
-	})
+	w.Header().Set("Content-Length", strconv.Itoa(len(avj)))
+	w.Write(avj)
 }
 
-func (s *server) handleGetOutput(w http.ResponseWriter, r *http.Request) {
+func (s *server) handleBatchGetActions(w http.ResponseWriter, r *http.Request, ns *namespace) {
+	var req cachers.BatchGetActionsRequest
+	if err := json.NewDecoder(io.LimitReader(r.Body, cachers.MaxBatchGetActions*1024)).Decode(&req); err != nil {
+		http.Error(w, "bad JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.ActionIDs) > cachers.MaxBatchGetActions {
+		http.Error(w, fmt.Sprintf("too many action IDs; max %d", cachers.MaxBatchGetActions), http.StatusBadRequest)
+		return
+	}
+	res := cachers.BatchGetActionsResponse{Actions: map[string]*cachers.ActionValue{}}
+	for _, actionID := range req.ActionIDs {
+		if !validHex(actionID) {
+			http.Error(w, "bad action ID", http.StatusBadRequest)
+			return
+		}
+		av, err := ns.lookupAction(r.Context(), actionID, s.inlineMaxSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.metrics.lookup("action", av != nil)
+		if av != nil {
+			res.Actions[actionID] = av
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&res)
+}
+
+// etagMatch reports whether the If-None-Match header value inm matches the
+// strong ETag etag.
+func etagMatch(inm, etag string) bool {
+	for _, v := range strings.Split(inm, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || strings.TrimPrefix(v, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *server) handleGetOutput(w http.ResponseWriter, r *http.Request, ns *namespace) {
 	outputID, ok := getHexSuffix(r, "/output/")
 	if !ok {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
-	w.Header().Set("Content-Type", "application/octet-stream")
-	_, diskPath, err := s.cache.Get(r.Context(), outputID)
+	var diskPath string
+	var err error
+	if r.Method == "HEAD" {
+		var has bool
+		diskPath, has, err = ns.hasOutput(r.Context(), outputID)
+		if err == nil && has && diskPath == "" {
+			// Only the origin has it. Its size isn't known without
+			// fetching it, so there's no Content-Length.
+			s.metrics.lookup("output", true)
+			w.Header().Set("Cache-Control", s.cacheControl("max-age=31536000, immutable"))
+			w.Header().Set("ETag", outputETag(outputID, ""))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	} else {
+		diskPath, _, err = ns.outputPath(r.Context(), outputID)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	http.ServeFile(w, r, diskPath)
+	s.metrics.lookup("output", diskPath != "")
+	if diskPath == "" {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	size, storedEnc, err := cachers.StatOutput(diskPath)
+	if err == nil {
+		var f *os.File
+		if f, err = os.Open(diskPath); err == nil {
+			defer f.Close()
+			s.serveOutput(w, r, outputID, f, size, storedEnc)
+			return
+		}
+	}
+	if os.IsNotExist(err) {
+		http.Error(w, "not found (post-stat)", http.StatusNotFound)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
 }
 
-func (s *server) handlePut(w http.ResponseWriter, r *http.Request) {
+func (s *server) handlePut(w http.ResponseWriter, r *http.Request, ns *namespace) {
 	ctx := r.Context()
 	if r.Method != "PUT" {
 		http.Error(w, "bad method", http.StatusMethodNotAllowed)
 		return
 	}
-	actionID, outputID, ok := strings.Cut(r.RequestURI[len("/"):], "/")
-	if !ok || !validHex(actionID) || !validHex(outputID) {
+	var actionID, outputID string
+	var ok bool
+	if strings.HasPrefix(r.URL.Path, "/output/") {
+		outputID, ok = getHexSuffix(r, "/output/")
+	} else {
+		actionID, outputID, ok = strings.Cut(r.URL.Path[len("/"):], "/")
+		ok = ok && validHex(actionID) && validHex(outputID)
+	}
+	if !ok {
 		http.Error(w, "bad URI", http.StatusBadRequest)
 		return
 	}
-	if r.ContentLength == -1 {
+	size := r.ContentLength
+	decode := func(r io.Reader) (io.Reader, error) { return r, nil }
+	if enc := r.Header.Get("Content-Encoding"); enc != "" {
+		if !cachers.ValidEncoding(enc) {
+			http.Error(w, "unsupported Content-Encoding", http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		if size, err = strconv.ParseInt(r.Header.Get(cachers.SizeHeader), 10, 64); err != nil || size < 0 {
+			http.Error(w, "missing or bad "+cachers.SizeHeader, http.StatusBadRequest)
+			return
+		}
+		var dec io.ReadCloser
+		defer func() {
+			if dec != nil {
+				dec.Close()
+			}
+		}()
+		decode = func(r io.Reader) (io.Reader, error) {
+			d, err := cachers.NewDecoder(r, enc)
+			if err != nil {
+				return nil, err
+			}
+			dec = d
+			return d, nil
+		}
+	} else if size == -1 {
 		http.Error(w, "missing Content-Length", http.StatusBadRequest)
 		return
 	}
-	_, err := s.cache.Put(ctx, actionID, outputID, r.ContentLength, r.Body)
+	if s.maxObjectSize > 0 && size > s.maxObjectSize {
+		http.Error(w, fmt.Sprintf("output of %d bytes exceeds the limit of %d", size, s.maxObjectSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if ns.overQuota(size) {
+		http.Error(w, errQuota.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	if !s.startUpload(w) {
+		return
+	}
+	defer s.endUpload()
+	digests, err := parseContentDigest(r.Header.Get("Content-Digest"))
 	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var body io.Reader = r.Body
+	if len(digests) > 0 || s.verifyOutputs {
+		wantID := ""
+		if s.verifyOutputs {
+			wantID = outputID
+		}
+		vr, err := newVerifyingReader(r.Body, decode, digests, wantID)
+		if err == nil && size == 0 {
+			// DiskCache doesn't read empty bodies, so check it here.
+			_, err = io.Copy(io.Discard, vr)
+		}
+		if err != nil {
+			s.putFailed(w, err)
+			return
+		}
+		body = vr
+	} else if body, err = decode(body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Don't let a body that's longer than it claims, or decompresses to
+	// more, fill the disk; DiskCache rejects it once it's one byte over.
+	body = io.LimitReader(body, size+1)
+	if err := ns.put(ctx, actionID, outputID, size, body); err != nil {
+		s.putFailed(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// putFailed writes the error response for a failed upload.
+func (s *server) putFailed(w http.ResponseWriter, err error) {
+	var de *digestError
+	if errors.As(err, &de) {
+		if s.verbose {
+			log.Printf("rejected upload: %v", err)
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errQuota) {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// handlePutAction stores an action for an output that's already on disk,
+// so clients don't need to re-upload identical outputs.
+func (s *server) handlePutAction(w http.ResponseWriter, r *http.Request, ns *namespace) {
+	actionID, ok := getHexSuffix(r, "/action/")
+	if !ok {
+		http.Error(w, "bad URI", http.StatusBadRequest)
+		return
+	}
+	var av cachers.ActionValue
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4<<10)).Decode(&av); err != nil {
+		http.Error(w, "bad JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validHex(av.OutputID) {
+		http.Error(w, "bad outputID", http.StatusBadRequest)
+		return
+	}
+	if err := ns.putAction(r.Context(), actionID, av.OutputID, av.Size); err != nil {
+		if os.IsNotExist(err) {
+			http.Error(w, "output not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, errQuota) {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
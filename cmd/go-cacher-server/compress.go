@@ -0,0 +1,126 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+// minCompressSize is the size below which outputs aren't compressed on the
+// fly, as it's not worth the CPU.
+const minCompressSize = 512
+
+// serveOutput writes the output outputID, of the given uncompressed size,
+// from f, which is stored in the content encoding storedEnc, or
+// uncompressed if empty. It negotiates the response's encoding with the
+// client.
+func (s *server) serveOutput(w http.ResponseWriter, r *http.Request, outputID string, f *os.File, size int64, storedEnc string) {
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Outputs are content-addressed, so they never change once written.
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Cache-Control", s.cacheControl("max-age=31536000, immutable"))
+	h.Set("Vary", "Accept-Encoding")
+	h.Set(cachers.SizeHeader, strconv.FormatInt(size, 10))
+
+	ae := r.Header.Get("Accept-Encoding")
+	switch {
+	case storedEnc != "" && cachers.AcceptsEncoding(ae, storedEnc):
+		h.Set("Content-Encoding", storedEnc)
+		h.Set("ETag", outputETag(outputID, storedEnc))
+		http.ServeContent(w, r, "", fi.ModTime(), f)
+	case storedEnc != "":
+		s.serveTranscoded(w, r, outputID, f, storedEnc, "", size)
+	case s.compressResponses && size >= minCompressSize && cachers.AcceptsEncoding(ae, cachers.EncodingZstd):
+		s.serveTranscoded(w, r, outputID, f, "", cachers.EncodingZstd, size)
+	case s.compressResponses && size >= minCompressSize && cachers.AcceptsEncoding(ae, cachers.EncodingGzip):
+		s.serveTranscoded(w, r, outputID, f, "", cachers.EncodingGzip, size)
+	default:
+		h.Set("ETag", outputETag(outputID, ""))
+		// ServeContent sets Content-Length, handles HEAD, If-None-Match and
+		// ranges.
+		http.ServeContent(w, r, "", fi.ModTime(), f)
+	}
+}
+
+// cacheControl returns a Cache-Control header value with the given
+// directives. Responses are only public when anyone may read them;
+// otherwise a shared proxy or CDN could hand them to anyone.
+func (s *server) cacheControl(directives string) string {
+	if s.auth.configured || s.root.readers != nil {
+		return "private, " + directives
+	}
+	for _, ns := range s.namespaces {
+		if ns.readers != nil {
+			return "private, " + directives
+		}
+	}
+	return "public, " + directives
+}
+
+// outputETag returns the strong ETag of the given encoding of an output.
+// Each encoding is a different representation, so it needs its own ETag.
+func outputETag(outputID, enc string) string {
+	if enc == "" {
+		return `"` + outputID + `"`
+	}
+	return `"` + outputID + "." + enc + `"`
+}
+
+// serveTranscoded writes src, which is in the content encoding fromEnc, in
+// the content encoding toEnc. Either may be empty, meaning uncompressed.
+// Transcoded responses don't support ranges.
+func (s *server) serveTranscoded(w http.ResponseWriter, r *http.Request, outputID string, src io.Reader, fromEnc, toEnc string, size int64) {
+	etag := outputETag(outputID, toEnc)
+	w.Header().Set("ETag", etag)
+	if etagMatch(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if toEnc == "" {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	} else {
+		w.Header().Set("Content-Encoding", toEnc)
+	}
+	if r.Method == "HEAD" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if fromEnc != "" {
+		dec, err := cachers.NewDecoder(src, fromEnc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer dec.Close()
+		src = dec
+	}
+	var dst io.Writer = w
+	if toEnc != "" {
+		enc, err := cachers.NewEncoder(w, toEnc, size)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer enc.Close()
+		dst = enc
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		// Too late for an error status. The client will notice the
+		// truncated body.
+		log.Printf("serving output %s: %v", outputID, err)
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "errors"
+
+// diskFree isn't implemented on this platform, so free space checks and
+// the automatic read-only mode are disabled.
+func diskFree(dir string) (int64, error) {
+	return 0, errDiskFreeUnsupported
+}
+
+var errDiskFreeUnsupported = errors.New("free space check unsupported on this platform")
@@ -0,0 +1,152 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// diskCheckInterval is how often the free space of the cache directory is
+// checked to enter or leave read-only mode.
+const diskCheckInterval = 10 * time.Second
+
+// checkWritable reports whether files can be created in the cache directory.
+func checkWritable() error {
+	f, err := os.CreateTemp(*dir, ".healthcheck-*")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	_, err = f.WriteString("ok")
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	os.Remove(name)
+	return err
+}
+
+// updateReadOnly checks the free space of the cache directory and puts the
+// server in or out of read-only mode, in which PUTs are rejected with 507,
+// so a full disk doesn't turn every upload into a 500. It returns the free
+// space, or -1 if it's unknown.
+func (s *server) updateReadOnly() int64 {
+	if *minFreeSpace <= 0 {
+		return -1
+	}
+	free, err := diskFree(*dir)
+	if err != nil {
+		return -1
+	}
+	low := free < *minFreeSpace
+	if s.readOnly.Swap(low) != low {
+		if low {
+			log.Printf("only %d bytes free in %s; switching to read-only mode", free, *dir)
+		} else {
+			log.Printf("%d bytes free in %s; leaving read-only mode", free, *dir)
+		}
+	}
+	return free
+}
+
+// watchDisk calls updateReadOnly every diskCheckInterval.
+func (s *server) watchDisk() {
+	s.updateReadOnly()
+	for range time.Tick(diskCheckInterval) {
+		s.updateReadOnly()
+	}
+}
+
+// handleHealthz reports whether the server is alive, which is whether its
+// cache directory is writable.
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if err := checkWritable(); err != nil {
+		http.Error(w, "cache directory not writable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether the server should get traffic. It isn't
+// ready while shutting down or if the cache directory isn't writable.
+// When free space is low it stays ready, as it can still serve reads, but
+// reports that it's read-only.
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	if err := checkWritable(); err != nil {
+		http.Error(w, "cache directory not writable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	free := s.updateReadOnly()
+	switch {
+	case s.readOnly.Load():
+		fmt.Fprintf(w, "ok; read-only, %d bytes free\n", free)
+	case free >= 0:
+		fmt.Fprintf(w, "ok; %d bytes free\n", free)
+	default:
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// shutdownOnSignal waits for SIGINT or SIGTERM, then shuts down hs.
+func (s *server) shutdownOnSignal(hs *http.Server) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-c
+	log.Printf("got %v; draining for up to %v", sig, *drainDelay+*drainTimeout)
+	s.shutdown(hs)
+}
+
+// shutdown fails /readyz and keeps serving for -drain-delay, so that load
+// balancers move new requests elsewhere. It then stops hs from accepting
+// connections and waits up to -drain-timeout for requests in progress,
+// including uploads, and for writes being forwarded to an origin.
+func (s *server) shutdown(hs *http.Server) {
+	s.draining.Store(true)
+	time.Sleep(*drainDelay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	if err := hs.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+		return
+	}
+	// Shutdown doesn't wait for the connections that the h2c handler
+	// hijacked from hs, so wait for their requests separately.
+	for s.inflight.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			log.Printf("shutdown: gave up waiting for %d requests", s.inflight.Load())
+			return
+		case <-time.After(drainPollInterval):
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		for _, ns := range s.allNamespaces() {
+			if wu := ns.origin(); wu != nil {
+				wu.Wait()
+			}
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("shutdown: gave up waiting for writes to the origin")
+	}
+}
+
+// drainPollInterval is how often shutdown checks for requests in progress.
+const drainPollInterval = 50 * time.Millisecond
@@ -0,0 +1,89 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestShutdownDrainsH2C(t *testing.T) {
+	setFlag(t, useH2C, true)
+	setFlag(t, drainDelay, 100*time.Millisecond)
+	setFlag(t, drainTimeout, 10*time.Second)
+	srv := newTestServer(t)
+	hs, err := newHTTPServer(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go hs.Serve(ln)
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+
+	// Start an upload and leave it half sent.
+	data := strings.Repeat("x", 1<<16)
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s/%s/%s", ln.Addr(), sha256Hex("action a"), sha256Hex(data)), pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.ContentLength = int64(len(data))
+	resc := make(chan *http.Response, 1)
+	go func() {
+		res, err := client.Do(req)
+		if err != nil {
+			t.Errorf("PUT: %v", err)
+		}
+		resc <- res
+	}()
+	io.WriteString(pw, data[:len(data)/2])
+	for srv.inflight.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		srv.shutdown(hs)
+		close(done)
+	}()
+	for !srv.draining.Load() {
+		time.Sleep(time.Millisecond)
+	}
+	if got := do(t, srv, "GET", "/readyz", "").StatusCode; got != http.StatusServiceUnavailable {
+		t.Errorf("/readyz while draining: %d; want 503", got)
+	}
+	select {
+	case <-done:
+		t.Fatalf("shutdown returned with an h2c upload in progress")
+	case <-time.After(*drainDelay + 200*time.Millisecond):
+	}
+
+	io.WriteString(pw, data[len(data)/2:])
+	pw.Close()
+	if res := <-resc; res != nil && res.StatusCode != http.StatusNoContent {
+		t.Errorf("PUT: %s; want 204", res.Status)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("shutdown didn't return after the upload finished")
+	}
+}
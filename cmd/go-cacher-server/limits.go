@@ -0,0 +1,142 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxIdleBuckets is the number of per-client token buckets above which
+// idle ones are forgotten.
+const maxIdleBuckets = 10000
+
+// rateLimiter limits the request rate of each client with a token bucket.
+// A nil *rateLimiter allows everything.
+type rateLimiter struct {
+	rate  float64 // tokens per second
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket // guarded by mu
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter allowing rate requests per second per
+// client, with bursts of up to burst, or nil if rate is zero.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+	}
+}
+
+// allow takes a token from client's bucket. If there's none, it returns
+// false and how long until there will be one.
+func (rl *rateLimiter) allow(client string, now time.Time) (ok bool, retryAfter time.Duration) {
+	if rl == nil {
+		return true, 0
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	b := rl.buckets[client]
+	if b == nil {
+		if len(rl.buckets) >= maxIdleBuckets {
+			rl.pruneLocked(now)
+		}
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[client] = b
+	}
+	b.tokens = math.Min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rl.rate * float64(time.Second))
+}
+
+// pruneLocked forgets the buckets that have refilled, as they're the same
+// as new ones. rl.mu must be held.
+func (rl *rateLimiter) pruneLocked(now time.Time) {
+	for client, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, client)
+		}
+	}
+}
+
+// clientKey returns the key that rate limits r: the identity it
+// authenticated as or, for anonymous requests, its IP address.
+func clientKey(r *http.Request, id identity) string {
+	if id.name != "anonymous" && id.name != "" {
+		return id.name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr // unix sockets have no port, or even address
+	}
+	return host
+}
+
+// checkRate applies the PUT or GET rate limit to r, writing a 429
+// response and returning false if it's exceeded.
+func (s *server) checkRate(w http.ResponseWriter, r *http.Request, id identity) bool {
+	rl := s.getLimiter
+	if r.Method == "PUT" {
+		rl = s.putLimiter
+	}
+	ok, retryAfter := rl.allow(clientKey(r, id), time.Now())
+	if !ok {
+		tooManyRequests(w, retryAfter)
+	}
+	return ok
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration) {
+	secs := int(math.Ceil(retryAfter.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(w, "too many requests", http.StatusTooManyRequests)
+}
+
+// startUpload reserves one of the -max-concurrent-uploads slots. If none
+// is free, it writes a 429 response and returns false. Otherwise the
+// caller must call endUpload.
+func (s *server) startUpload(w http.ResponseWriter) bool {
+	if s.uploads == nil {
+		return true
+	}
+	select {
+	case s.uploads <- struct{}{}:
+		return true
+	default:
+		tooManyRequests(w, time.Second)
+		return false
+	}
+}
+
+func (s *server) endUpload() {
+	if s.uploads != nil {
+		<-s.uploads
+	}
+}
@@ -0,0 +1,70 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(2, 3) // 2/s, bursts of 3
+	now := time.Unix(1e9, 0)
+	steps := []struct {
+		client string
+		after  time.Duration
+		wantOK bool
+	}{
+		{"a", 0, true},
+		{"a", 0, true},
+		{"a", 0, true},
+		{"a", 0, false}, // burst used up
+		{"b", 0, true},  // buckets are per client
+		{"a", 499 * time.Millisecond, false},
+		{"a", time.Millisecond, true}, // half a second refills one token
+		{"a", 0, false},
+		{"a", time.Hour, true}, // refills to the burst, no more
+		{"a", 0, true},
+		{"a", 0, true},
+		{"a", 0, false},
+	}
+	for i, st := range steps {
+		now = now.Add(st.after)
+		ok, retryAfter := rl.allow(st.client, now)
+		if ok != st.wantOK {
+			t.Fatalf("step %d: allow(%s) = %v; want %v", i, st.client, ok, st.wantOK)
+		}
+		if !ok && (retryAfter <= 0 || retryAfter > 500*time.Millisecond) {
+			t.Errorf("step %d: retryAfter = %v; want (0, 500ms]", i, retryAfter)
+		}
+	}
+
+	var nilLimiter *rateLimiter
+	if ok, _ := nilLimiter.allow("a", now); !ok {
+		t.Errorf("nil limiter refused a request")
+	}
+}
+
+func TestRateLimitedRequests(t *testing.T) {
+	setFlag(t, anonymousScopes, "read,write")
+	srv := newTestServer(t)
+	srv.putLimiter = newRateLimiter(1, 1)
+	actionID, outputID := sha256Hex("action a"), sha256Hex("data")
+	put := func() *http.Response {
+		return do(t, srv, "PUT", "/"+actionID+"/"+outputID, "data")
+	}
+	if res := put(); res.StatusCode != http.StatusNoContent {
+		t.Fatalf("first PUT: %s", res.Status)
+	}
+	res := put()
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") != "1" {
+		t.Errorf("second PUT: %s, Retry-After %q; want 429, 1", res.Status, res.Header.Get("Retry-After"))
+	}
+	// GETs have their own limit.
+	if res := do(t, srv, "GET", "/action/"+actionID, ""); res.StatusCode != http.StatusOK {
+		t.Errorf("GET after PUTs were limited: %s", res.Status)
+	}
+}
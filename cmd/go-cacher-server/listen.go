@@ -0,0 +1,134 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// newHTTPServer returns the server for handler, configured from the TLS
+// and HTTP/2 flags.
+func newHTTPServer(handler http.Handler) (*http.Server, error) {
+	if *useH2C {
+		// Cleartext HTTP/2 with prior knowledge, for trusted networks.
+		// TLS connections negotiate HTTP/2 by themselves.
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	hs := &http.Server{Handler: handler}
+	if *tlsCert == "" {
+		if *tlsClientCA != "" {
+			return nil, errors.New("-tls-client-ca requires -tls-cert")
+		}
+		return hs, nil
+	}
+	cr := &certReloader{certFile: *tlsCert, keyFile: *tlsKey}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	go cr.reloadOnSIGHUP()
+	hs.TLSConfig = &tls.Config{GetCertificate: cr.getCertificate}
+	if *tlsClientCA != "" {
+		pem, err := os.ReadFile(*tlsClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", *tlsClientCA)
+		}
+		hs.TLSConfig.ClientCAs = pool
+		// Clients without a certificate may still use a token or password.
+		hs.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return hs, nil
+}
+
+// serve serves hs on addr, which is a TCP address, or "unix:" followed by
+// the path of a unix domain socket.
+func serve(hs *http.Server, addr string) error {
+	ln, err := listenAddr(addr)
+	if err != nil {
+		return err
+	}
+	if hs.TLSConfig != nil {
+		// The certificate comes from TLSConfig.GetCertificate.
+		return hs.ServeTLS(ln, "", "")
+	}
+	return hs.Serve(ln)
+}
+
+func listenAddr(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	path = strings.TrimPrefix(path, "//")
+	// Remove a socket left behind by a previous run. Refuse to remove
+	// anything else.
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and isn't a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// certReloader holds the server's TLS certificate, reloading it from disk
+// on SIGHUP so it can be rotated without a restart.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu   sync.Mutex
+	cert *tls.Certificate // guarded by mu
+}
+
+func (cr *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert = &cert
+	return nil
+}
+
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return cr.cert, nil
+}
+
+// reloadOnSIGHUP reloads the certificate whenever the process gets SIGHUP.
+// If a reload fails, the previous certificate stays in use.
+func (cr *certReloader) reloadOnSIGHUP() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := cr.load(); err != nil {
+			log.Printf("SIGHUP: %v; keeping the previous certificate", err)
+			continue
+		}
+		log.Printf("SIGHUP: reloaded TLS certificate from %s", cr.certFile)
+	}
+}
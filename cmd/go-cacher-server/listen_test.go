@@ -0,0 +1,182 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestServeUnixSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no unix sockets")
+	}
+	// Socket paths are limited to about 100 bytes, which t.TempDir can
+	// exceed.
+	dir, err := os.MkdirTemp("", "cacher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "s")
+
+	// A socket left behind by a previous run is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	srv := newTestServer(t)
+	hs := &http.Server{Handler: srv}
+	errc := make(chan error, 1)
+	go func() { errc <- serve(hs, "unix:"+path) }()
+	defer hs.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		},
+	}}
+	outputID := sha256Hex("data")
+	var res *http.Response
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		res, err = client.Get("http://unix/output/" + outputID)
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		select {
+		case err := <-errc:
+			t.Fatalf("serve: %v", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if err != nil {
+		t.Fatalf("GET over the unix socket: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET of a missing output over the unix socket: %s; want 404", res.Status)
+	}
+
+	// Anything else at the path is left alone.
+	other := filepath.Join(dir, "file")
+	if err := os.WriteFile(other, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := listenAddr("unix:" + other); err == nil {
+		ln.Close()
+		t.Errorf("listening on a regular file's path succeeded")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("regular file was removed: %v", err)
+	}
+}
+
+// writeCert writes a new self-signed certificate for localhost with the
+// given serial number, and its key, to certFile and keyFile.
+func writeCert(t *testing.T, certFile, keyFile string, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReload(t *testing.T) {
+	dir := t.TempDir()
+	cr := &certReloader{certFile: filepath.Join(dir, "cert.pem"), keyFile: filepath.Join(dir, "key.pem")}
+	writeCert(t, cr.certFile, cr.keyFile, 1)
+	if err := cr.load(); err != nil {
+		t.Fatal(err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{GetCertificate: cr.getCertificate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.(*tls.Conn).Handshake()
+			c.Close()
+		}
+	}()
+	servedSerial := func() int64 {
+		t.Helper()
+		c, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		return c.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	if got := servedSerial(); got != 1 {
+		t.Fatalf("served certificate %d; want 1", got)
+	}
+
+	// Swapping the files changes nothing until a reload.
+	writeCert(t, cr.certFile, cr.keyFile, 2)
+	if got := servedSerial(); got != 1 {
+		t.Errorf("served certificate %d before the reload; want 1", got)
+	}
+	if err := cr.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedSerial(); got != 2 {
+		t.Errorf("served certificate %d after the reload; want 2", got)
+	}
+
+	// A failed reload keeps the previous certificate.
+	if err := os.WriteFile(cr.keyFile, []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := cr.load(); err == nil {
+		t.Errorf("loading a broken key succeeded")
+	}
+	if got := servedSerial(); got != 2 {
+		t.Errorf("served certificate %d after a failed reload; want 2", got)
+	}
+}
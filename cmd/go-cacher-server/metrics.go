@@ -0,0 +1,300 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request latency
+// histogram buckets.
+var latencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// diskUsageMaxAge is how long a disk usage measurement is reused for, as
+// walking a large cache directory on every scrape would be slow.
+const diskUsageMaxAge = time.Minute
+
+// metrics are the server's counters, exported in the Prometheus text
+// format by ServeHTTP.
+type metrics struct {
+	mu       sync.Mutex
+	requests map[routeCode]int64   // guarded by mu
+	latency  map[string]*histogram // guarded by mu; by route
+	lookups  map[lookupResult]*atomic.Int64
+
+	bytesIn  atomic.Int64 // request bodies
+	bytesOut atomic.Int64 // response bodies
+
+	diskMu       sync.Mutex
+	diskBytes    int64     // guarded by diskMu
+	diskMeasured time.Time // guarded by diskMu
+}
+
+type routeCode struct {
+	route string
+	code  int
+}
+
+type lookupResult struct {
+	kind string // "action" or "output"
+	hit  bool
+}
+
+type histogram struct {
+	counts []int64 // per bucket, not cumulative; the last is +Inf
+	sum    float64
+	count  int64
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		requests: map[routeCode]int64{},
+		latency:  map[string]*histogram{},
+		lookups:  map[lookupResult]*atomic.Int64{},
+	}
+	for _, kind := range []string{"action", "output"} {
+		for _, hit := range []bool{true, false} {
+			m.lookups[lookupResult{kind, hit}] = new(atomic.Int64)
+		}
+	}
+	return m
+}
+
+// lookup records a cache hit or miss for kind, which is "action" or
+// "output".
+func (m *metrics) lookup(kind string, hit bool) {
+	m.lookups[lookupResult{kind, hit}].Add(1)
+}
+
+func (m *metrics) observe(route string, code int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[routeCode{route, code}]++
+	h := m.latency[route]
+	if h == nil {
+		h = &histogram{counts: make([]int64, len(latencyBuckets)+1)}
+		m.latency[route] = h
+	}
+	sec := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, sec)
+	h.counts[i]++
+	h.sum += sec
+	h.count++
+}
+
+// routeOf returns the metrics label for the endpoint r is for.
+func routeOf(r *http.Request) string {
+	p := r.URL.Path
+	if rest, ok := strings.CutPrefix(p, "/ns/"); ok {
+		_, rest, _ = strings.Cut(rest, "/")
+		p = "/" + rest
+	}
+	switch {
+	case p == "/metrics":
+		return "metrics"
+	case p == "/":
+		return "root"
+	case p == "/healthz" || p == "/readyz":
+		return "health"
+	case strings.HasPrefix(p, "/admin/"):
+		return "admin"
+	case r.Method == "POST" && p == "/actions:batchGet":
+		return "batch_get_actions"
+	case r.Method == "PUT" && (strings.HasPrefix(p, "/action/") || strings.HasPrefix(p, "/ac/")):
+		return "put_action"
+	case r.Method == "PUT":
+		return "put"
+	case strings.HasPrefix(p, "/action/") || strings.HasPrefix(p, "/ac/"):
+		return "get_action"
+	case strings.HasPrefix(p, "/output/") || strings.HasPrefix(p, "/cas/"):
+		return "get_output"
+	}
+	return "other"
+}
+
+// diskUsage returns the total size of the files under dir, measuring it
+// at most every diskUsageMaxAge.
+func (m *metrics) diskUsage(dir string) (int64, error) {
+	m.diskMu.Lock()
+	defer m.diskMu.Unlock()
+	if time.Since(m.diskMeasured) < diskUsageMaxAge {
+		return m.diskBytes, nil
+	}
+	var n int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return nil // removed since listing
+			}
+			n += fi.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	m.diskBytes, m.diskMeasured = n, time.Now()
+	return n, nil
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	disk, diskErr := m.diskUsage(*dir)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	header := func(name, typ, help string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	m.mu.Lock()
+	rcs := make([]routeCode, 0, len(m.requests))
+	for rc := range m.requests {
+		rcs = append(rcs, rc)
+	}
+	sort.Slice(rcs, func(i, j int) bool {
+		if rcs[i].route != rcs[j].route {
+			return rcs[i].route < rcs[j].route
+		}
+		return rcs[i].code < rcs[j].code
+	})
+	header("gocacher_http_requests_total", "counter", "HTTP requests by route and status code.")
+	for _, rc := range rcs {
+		fmt.Fprintf(bw, "gocacher_http_requests_total{route=%q,code=\"%d\"} %d\n", rc.route, rc.code, m.requests[rc])
+	}
+
+	routes := make([]string, 0, len(m.latency))
+	for route := range m.latency {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	header("gocacher_http_request_duration_seconds", "histogram", "HTTP request latency by route.")
+	for _, route := range routes {
+		h := m.latency[route]
+		var cum int64
+		for i, le := range latencyBuckets {
+			cum += h.counts[i]
+			fmt.Fprintf(bw, "gocacher_http_request_duration_seconds_bucket{route=%q,le=%q} %d\n", route, strconv.FormatFloat(le, 'g', -1, 64), cum)
+		}
+		fmt.Fprintf(bw, "gocacher_http_request_duration_seconds_bucket{route=%q,le=\"+Inf\"} %d\n", route, h.count)
+		fmt.Fprintf(bw, "gocacher_http_request_duration_seconds_sum{route=%q} %g\n", route, h.sum)
+		fmt.Fprintf(bw, "gocacher_http_request_duration_seconds_count{route=%q} %d\n", route, h.count)
+	}
+	m.mu.Unlock()
+
+	header("gocacher_lookups_total", "counter", "Cache lookups by kind (action or output) and result (hit or miss).")
+	for _, kind := range []string{"action", "output"} {
+		fmt.Fprintf(bw, "gocacher_lookups_total{kind=%q,result=\"hit\"} %d\n", kind, m.lookups[lookupResult{kind, true}].Load())
+		fmt.Fprintf(bw, "gocacher_lookups_total{kind=%q,result=\"miss\"} %d\n", kind, m.lookups[lookupResult{kind, false}].Load())
+	}
+
+	header("gocacher_http_request_bytes_total", "counter", "Bytes of HTTP request bodies received.")
+	fmt.Fprintf(bw, "gocacher_http_request_bytes_total %d\n", m.bytesIn.Load())
+	header("gocacher_http_response_bytes_total", "counter", "Bytes of HTTP response bodies sent.")
+	fmt.Fprintf(bw, "gocacher_http_response_bytes_total %d\n", m.bytesOut.Load())
+
+	if diskErr == nil {
+		header("gocacher_disk_usage_bytes", "gauge", "Size of the files in the cache directory.")
+		fmt.Fprintf(bw, "gocacher_disk_usage_bytes %d\n", disk)
+	}
+}
+
+// instrument wraps h to record request metrics.
+func (m *metrics) instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		mw := &meteredWriter{ResponseWriter: w, m: m}
+		if r.Body != nil {
+			r.Body = &meteredBody{ReadCloser: r.Body, m: m}
+		}
+		h.ServeHTTP(mw, r)
+		code := mw.code
+		if code == 0 {
+			code = http.StatusOK
+		}
+		m.observe(routeOf(r), code, time.Since(start))
+	})
+}
+
+// meteredWriter is a ResponseWriter that records the status code and
+// counts body bytes. It passes io.ReaderFrom and http.Flusher through.
+type meteredWriter struct {
+	http.ResponseWriter
+	m    *metrics
+	code int
+}
+
+func (w *meteredWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *meteredWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.m.bytesOut.Add(int64(n))
+	return n, err
+}
+
+// ReadFrom keeps the underlying ResponseWriter's io.ReaderFrom, which
+// http.ServeContent uses to send files with sendfile.
+func (w *meteredWriter) ReadFrom(src io.Reader) (int64, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(w.ResponseWriter, src)
+	}
+	w.m.bytesOut.Add(n)
+	return n, err
+}
+
+func (w *meteredWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap is for http.ResponseController.
+func (w *meteredWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// meteredBody is a request body that counts the bytes read from it.
+type meteredBody struct {
+	io.ReadCloser
+	m *metrics
+}
+
+func (b *meteredBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.m.bytesIn.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,57 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readFromRecorder is a ResponseRecorder that counts ReadFrom calls, like
+// net/http's own ResponseWriter uses for sendfile.
+type readFromRecorder struct {
+	*httptest.ResponseRecorder
+	readFroms int
+}
+
+func (r *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFroms++
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestMeteredWriterKeepsReadFrom(t *testing.T) {
+	data := strings.Repeat("x", 10000)
+	file := filepath.Join(t.TempDir(), "out")
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := newMetrics()
+	h := m.instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		http.ServeContent(w, r, "", time.Time{}, f)
+	}))
+
+	rec := &readFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/output/abcd", nil))
+	if rec.Body.String() != data {
+		t.Fatalf("got %d bytes; want %d", rec.Body.Len(), len(data))
+	}
+	if rec.readFroms == 0 {
+		t.Errorf("ServeContent didn't use the ResponseWriter's ReadFrom")
+	}
+	if got := m.bytesOut.Load(); got != int64(len(data)) {
+		t.Errorf("bytesOut = %d; want %d", got, len(data))
+	}
+}
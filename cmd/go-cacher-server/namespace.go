@@ -0,0 +1,489 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+// namespace is an isolated part of the cache, such as one for main branch
+// builds and one for pull requests.
+type namespace struct {
+	name   string // empty for the default namespace
+	disk   *cachers.DiskCache
+	cache  store      // disk, or disk with an origin; see newNamespace
+	parent *namespace // optional; read through to on misses, never written
+
+	// readers and writers optionally restrict which identities may read
+	// and write, on top of the scopes they're granted. Nil means anyone.
+	readers []string
+	writers []string
+
+	quota int64        // maximum bytes of outputs; 0 means unlimited
+	used  atomic.Int64 // approximate bytes of outputs stored
+}
+
+// namespaceConfig is the JSON form of a namespace in the -namespaces-file,
+// which maps names to configs. The empty name configures the default
+// namespace.
+type namespaceConfig struct {
+	// Read and Write optionally list the identities allowed to read and
+	// write, like "token:ci", "user:alice", "cert:builder" or "anonymous".
+	// A trailing "*" matches any suffix, so "*" alone matches everyone.
+	Read  []string `json:"read"`
+	Write []string `json:"write"`
+
+	// Parent optionally names a namespace whose entries are visible in
+	// this one. Writes never go to the parent.
+	Parent string `json:"parent"`
+
+	// QuotaBytes optionally limits the total size of the namespace's
+	// outputs on disk, which is after -compress-at-rest, including those
+	// fetched from an origin. Zero means no limit.
+	QuotaBytes int64 `json:"quotaBytes"`
+}
+
+// validNamespace reports whether name is usable as a namespace name and
+// directory.
+func validNamespace(name string) bool {
+	if name == "" || len(name) > 64 || name[0] == '.' || name[0] == '-' {
+		return false
+	}
+	for i := range name {
+		b := name[i]
+		if b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == '-' || b == '_' || b == '.' {
+			continue
+		}
+		return false
+	}
+	return true
+}
+
+// newNamespace returns the namespace called name, stored in dir, which is
+// created if needed. If an origin is configured, misses are fetched from it
+// and writes are forwarded to it.
+func newNamespace(name, dir string) (*namespace, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	ns := &namespace{
+		name: name,
+		disk: &cachers.DiskCache{
+			Dir:             dir,
+			Verbose:         *verbose,
+			CompressOutputs: *compressAtRest,
+		},
+	}
+	local := quotaStore{ns.disk, ns}
+	ns.cache = local
+	up, err := newOrigin(name)
+	if err != nil {
+		return nil, err
+	}
+	if up != nil {
+		ns.cache = up
+		up.Local = local
+	}
+	return ns, nil
+}
+
+// quotaStore is a namespace's DiskCache, which accounts for the bytes of
+// the outputs stored in it, and refuses those that would take the
+// namespace over its quota, whether they're uploaded or fetched from an
+// origin.
+type quotaStore struct {
+	*cachers.DiskCache
+	ns *namespace
+}
+
+func (q quotaStore) Put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) (diskPath string, err error) {
+	return q.add(ctx, actionID, outputID, size, func() (string, error) {
+		return q.DiskCache.Put(ctx, actionID, outputID, size, body)
+	})
+}
+
+func (q quotaStore) PutOutput(ctx context.Context, outputID string, size int64, body io.Reader) (diskPath string, err error) {
+	return q.add(ctx, "", outputID, size, func() (string, error) {
+		return q.DiskCache.PutOutput(ctx, outputID, size, body)
+	})
+}
+
+// add stores an output of the given size, or of unknown size if negative,
+// with put, and accounts for the bytes it takes on disk. If those take ns
+// over its quota, the output, and the action if any, are removed again.
+func (q quotaStore) add(ctx context.Context, actionID, outputID string, size int64, put func() (string, error)) (string, error) {
+	ns := q.ns
+	had, err := q.OutputPath(ctx, outputID)
+	if err != nil {
+		return "", err
+	}
+	if had != "" {
+		return put()
+	}
+	if ns.overQuota(size) {
+		return "", errQuota
+	}
+	diskPath, err := put()
+	if err != nil {
+		return "", err
+	}
+	fi, err := os.Stat(diskPath)
+	if err != nil {
+		return diskPath, nil
+	}
+	if used := ns.used.Add(fi.Size()); ns.quota > 0 && used > ns.quota {
+		if actionID != "" {
+			q.DeleteAction(actionID)
+		}
+		freed, _ := q.DeleteOutput(outputID)
+		ns.used.Add(-freed)
+		return "", errQuota
+	}
+	return diskPath, nil
+}
+
+// configureNamespaces sets up s.root and s.namespaces from the -cache-dir
+// and -namespaces-file flags. Named namespaces are stored in
+// <cache-dir>/ns/<name>.
+func (s *server) configureNamespaces() error {
+	var err error
+	if s.root, err = newNamespace("", *dir); err != nil {
+		return err
+	}
+	s.namespaces = map[string]*namespace{}
+	if *namespacesFile == "" {
+		return nil
+	}
+	j, err := os.ReadFile(*namespacesFile)
+	if err != nil {
+		return err
+	}
+	var confs map[string]namespaceConfig
+	if err := json.Unmarshal(j, &confs); err != nil {
+		return fmt.Errorf("%s: %v", *namespacesFile, err)
+	}
+	for name := range confs {
+		if name == "" {
+			continue
+		}
+		if !validNamespace(name) {
+			return fmt.Errorf("%s: invalid namespace name %q", *namespacesFile, name)
+		}
+		ns, err := newNamespace(name, filepath.Join(*dir, "ns", name))
+		if err != nil {
+			return err
+		}
+		s.namespaces[name] = ns
+	}
+	for name, conf := range confs {
+		ns := s.lookupNamespace(name)
+		ns.readers = conf.Read
+		ns.writers = conf.Write
+		ns.quota = conf.QuotaBytes
+		if conf.Parent == "" {
+			continue
+		}
+		parent := s.lookupNamespace(conf.Parent)
+		if parent == nil {
+			return fmt.Errorf("%s: namespace %q has unknown parent %q", *namespacesFile, name, conf.Parent)
+		}
+		ns.parent = parent
+	}
+	for _, ns := range s.allNamespaces() {
+		seen := map[*namespace]bool{}
+		for p := ns; p != nil; p = p.parent {
+			if seen[p] {
+				return fmt.Errorf("%s: namespace %q has a parent cycle", *namespacesFile, ns.name)
+			}
+			seen[p] = true
+		}
+		if ns.quota > 0 {
+			n, err := outputBytes(ns.disk.Dir)
+			if err != nil {
+				return err
+			}
+			ns.used.Store(n)
+		}
+	}
+	return nil
+}
+
+// origin returns ns's WithUpstream, or nil if it has no origin.
+func (ns *namespace) origin() *cachers.WithUpstream {
+	wu, _ := ns.cache.(*cachers.WithUpstream)
+	return wu
+}
+
+// lookupNamespace returns the namespace called name, or nil if there's none.
+// The empty name is the default namespace.
+func (s *server) lookupNamespace(name string) *namespace {
+	if name == "" {
+		return s.root
+	}
+	return s.namespaces[name]
+}
+
+func (s *server) allNamespaces() []*namespace {
+	all := []*namespace{s.root}
+	for _, ns := range s.namespaces {
+		all = append(all, ns)
+	}
+	return all
+}
+
+// outputBytes returns the total size of the output files in dir.
+func outputBytes(dir string) (int64, error) {
+	var n int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.HasPrefix(d.Name(), "o-") {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		n += fi.Size()
+		return nil
+	})
+	return n, err
+}
+
+// splitNamespace returns the namespace that r addresses and r with the
+// "/ns/<name>" prefix removed from its path. If r names an unknown
+// namespace, ns is nil.
+func (s *server) splitNamespace(r *http.Request) (ns *namespace, _ *http.Request) {
+	rest, ok := strings.CutPrefix(r.URL.Path, "/ns/")
+	if !ok {
+		return s.root, r
+	}
+	name, rest, _ := strings.Cut(rest, "/")
+	ns = s.namespaces[name]
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = "/" + rest
+	r2.URL.RawPath = ""
+	return ns, r2
+}
+
+// allowed reports whether id may use ns with the scopes need.
+func (ns *namespace) allowed(id identity, need scopes) bool {
+	if need&scopeRead != 0 && ns.readers != nil && !matchIdentity(ns.readers, id.name) {
+		return false
+	}
+	if need&scopeWrite != 0 && ns.writers != nil && !matchIdentity(ns.writers, id.name) {
+		return false
+	}
+	return true
+}
+
+func matchIdentity(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// overQuota reports whether storing an output of the given size would
+// exceed ns's quota. A negative size means it's unknown. Quotas count the
+// bytes outputs take on disk, which with -compress-at-rest aren't known
+// until they're written, so then only a full namespace is refused up front;
+// quotaStore checks the rest.
+func (ns *namespace) overQuota(size int64) bool {
+	if ns.quota <= 0 {
+		return false
+	}
+	if size < 0 || ns.disk.CompressOutputs {
+		return ns.used.Load() >= ns.quota
+	}
+	return ns.used.Load()+size > ns.quota
+}
+
+// lookupAction returns the ActionValue for actionID from ns or its
+// parents, or nil if none has it. Outputs of up to inlineMax bytes are
+// included in it.
+func (ns *namespace) lookupAction(ctx context.Context, actionID string, inlineMax int64) (*cachers.ActionValue, error) {
+	for ; ns != nil; ns = ns.parent {
+		outputID, diskPath, err := ns.cache.Get(ctx, actionID)
+		if errors.Is(err, errQuota) {
+			// Fetched from the origin, but there's no room for it.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if outputID == "" {
+			continue
+		}
+		size, enc, err := cachers.StatOutput(diskPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		av := &cachers.ActionValue{
+			OutputID: outputID,
+			Size:     size,
+		}
+		if size > 0 && size <= inlineMax {
+			if av.Data, err = readInline(diskPath, enc, size); err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+		}
+		return av, nil
+	}
+	return nil, nil
+}
+
+// readInline reads the output of the given size stored at diskPath with
+// the content encoding enc.
+func readInline(diskPath, enc string, size int64) ([]byte, error) {
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if enc != "" {
+		dec, err := cachers.NewDecoder(f, enc)
+		if err != nil {
+			return nil, err
+		}
+		defer dec.Close()
+		r = dec
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", diskPath, err)
+	}
+	return data, nil
+}
+
+// outputPath returns the disk path of outputID in ns or its parents, or ""
+// if none has it. The from return value is the namespace it was found in.
+func (ns *namespace) outputPath(ctx context.Context, outputID string) (diskPath string, from *namespace, err error) {
+	for ; ns != nil; ns = ns.parent {
+		diskPath, err := ns.cache.OutputPath(ctx, outputID)
+		if errors.Is(err, errQuota) {
+			continue
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if diskPath != "" {
+			return diskPath, ns, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// hasOutput is outputPath for HEAD requests, which shouldn't download
+// outputs just to say they exist. If no namespace in ns's chain has
+// outputID on disk, their origins are asked whether they have it, in which
+// case diskPath is "" and has is true.
+func (ns *namespace) hasOutput(ctx context.Context, outputID string) (diskPath string, has bool, err error) {
+	for n := ns; n != nil; n = n.parent {
+		diskPath, err := n.disk.OutputPath(ctx, outputID)
+		if err != nil || diskPath != "" {
+			return diskPath, diskPath != "", err
+		}
+	}
+	for n := ns; n != nil; n = n.parent {
+		if wu := n.origin(); wu != nil && wu.Policy.CanRead() {
+			has, err := wu.Upstream.HasOutput(ctx, outputID)
+			if err != nil || has {
+				return "", has, err
+			}
+		}
+	}
+	return "", false, nil
+}
+
+// put stores an output in ns. If actionID is empty, only the output is
+// stored.
+func (ns *namespace) put(ctx context.Context, actionID, outputID string, size int64, body io.Reader) error {
+	var err error
+	if actionID == "" {
+		_, err = ns.cache.PutOutput(ctx, outputID, size, body)
+	} else {
+		_, err = ns.cache.Put(ctx, actionID, outputID, size, body)
+	}
+	return err
+}
+
+// putAction records actionID as producing outputID in ns. If the output is
+// only in one of ns's parents, it's copied into ns first, as entries in a
+// namespace must not depend on its parents keeping theirs.
+func (ns *namespace) putAction(ctx context.Context, actionID, outputID string, size int64) error {
+	diskPath, from, err := ns.outputPath(ctx, outputID)
+	if err != nil {
+		return err
+	}
+	if diskPath == "" {
+		return fs.ErrNotExist
+	}
+	if from == ns {
+		_, err := ns.cache.PutAction(ctx, actionID, outputID, size)
+		return err
+	}
+	storedSize, enc, err := cachers.StatOutput(diskPath)
+	if err != nil {
+		return err
+	}
+	if storedSize != size {
+		return fmt.Errorf("output %s has size %d, expected %d", outputID, storedSize, size)
+	}
+	f, err := os.Open(diskPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var body io.Reader = f
+	if enc != "" {
+		dec, err := cachers.NewDecoder(f, enc)
+		if err != nil {
+			return err
+		}
+		defer dec.Close()
+		body = dec
+	}
+	return ns.put(ctx, actionID, outputID, size, body)
+}
+
+// errQuota is returned when a write would exceed a namespace's quota.
+var errQuota = errors.New("namespace quota exceeded")
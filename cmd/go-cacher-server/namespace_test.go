@@ -0,0 +1,127 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNamespaceAccessLists(t *testing.T) {
+	setFlag(t, tokenFile, writeFile(t, "read,write ci-secret ci\nread,write dev-secret dev\n"))
+	setFlag(t, namespacesFile, writeFile(t, `{
+		"main": {"read": ["*"], "write": ["token:ci"]},
+		"pr": {"read": ["token:dev", "token:ci"], "write": ["token:dev"], "parent": "main"}
+	}`))
+	srv := newTestServer(t)
+	ci := []string{"Authorization", "Bearer ci-secret"}
+	dev := []string{"Authorization", "Bearer dev-secret"}
+
+	actionID, outputID := sha256Hex("action a"), sha256Hex("data")
+	put := func(ns string, creds []string) int {
+		return do(t, srv, "PUT", fmt.Sprintf("/ns/%s/%s/%s", ns, actionID, outputID), "data", creds...).StatusCode
+	}
+	if got := put("main", dev); got != http.StatusForbidden {
+		t.Errorf("dev PUT to main: %d; want 403", got)
+	}
+	if got := put("main", ci); got != http.StatusNoContent {
+		t.Errorf("ci PUT to main: %d; want 204", got)
+	}
+	if got := put("pr", ci); got != http.StatusForbidden {
+		t.Errorf("ci PUT to pr: %d; want 403", got)
+	}
+	// pr reads through to main.
+	if got := do(t, srv, "GET", "/ns/pr/action/"+actionID, "", dev...).StatusCode; got != http.StatusOK {
+		t.Errorf("dev GET from pr: %d; want 200", got)
+	}
+	if got := do(t, srv, "GET", "/action/"+actionID, "", dev...).StatusCode; got != http.StatusNotFound {
+		t.Errorf("GET from default namespace: %d; want 404", got)
+	}
+	if got := do(t, srv, "GET", "/ns/nope/action/"+actionID, "", dev...).StatusCode; got != http.StatusNotFound {
+		t.Errorf("GET from unknown namespace: %d; want 404", got)
+	}
+}
+
+func TestNamespaceQuota(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			setFlag(t, compressAtRest, compress)
+			setFlag(t, namespacesFile, writeFile(t, `{"small": {"quotaBytes": 3000}}`))
+			srv := newTestServer(t)
+			put := func(name, data string) int {
+				actionID, outputID := sha256Hex("action "+name), sha256Hex(data)
+				return do(t, srv, "PUT", fmt.Sprintf("/ns/small/%s/%s", actionID, outputID), data).StatusCode
+			}
+			// Compressible outputs that take little space at rest.
+			for i := 0; i < 3; i++ {
+				got := put(fmt.Sprint(i), strings.Repeat(fmt.Sprint(i), 2000))
+				want := http.StatusNoContent
+				if !compress && i > 0 {
+					want = http.StatusInsufficientStorage
+				}
+				if got != want {
+					t.Errorf("PUT %d: %d; want %d", i, got, want)
+				}
+			}
+			ns := srv.namespaces["small"]
+			if used, n := ns.used.Load(), mustOutputBytes(t, ns.disk.Dir); used != n {
+				t.Errorf("used = %d; want %d, the bytes on disk", used, n)
+			}
+			// Incompressible ones fill it up either way.
+			var got int
+			for i := 0; i < 3 && got != http.StatusInsufficientStorage; i++ {
+				got = put(fmt.Sprint("random", i), randomString(t, 2000))
+			}
+			if got != http.StatusInsufficientStorage {
+				t.Errorf("namespace never filled up")
+			}
+			if used := ns.used.Load(); used > ns.quota {
+				t.Errorf("used %d bytes of a %d byte quota", used, ns.quota)
+			}
+		})
+	}
+}
+
+func mustOutputBytes(t *testing.T, dir string) int64 {
+	t.Helper()
+	n, err := outputBytes(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestNamespaceQuotaOriginFill(t *testing.T) {
+	origin := newTestServer(t)
+	actionID, _ := putOutput(t, origin, "big", strings.Repeat("x", 5000))
+	ots := httptest.NewServer(origin)
+	defer ots.Close()
+
+	setFlag(t, originServer, ots.URL)
+	setFlag(t, namespacesFile, writeFile(t, `{"": {"quotaBytes": 1000}}`))
+	edge := newTestServer(t)
+	if got := do(t, edge, "GET", "/action/"+actionID, "").StatusCode; got != http.StatusNotFound {
+		t.Errorf("GET of an output over the quota through the edge: %d; want 404", got)
+	}
+	if used := edge.root.used.Load(); used != 0 {
+		t.Errorf("edge used %d bytes; want 0", used)
+	}
+	if n := mustOutputBytes(t, edge.root.disk.Dir); n != 0 {
+		t.Errorf("edge has %d bytes of outputs on disk; want 0", n)
+	}
+}
+
+// randomString returns n incompressible bytes.
+func randomString(t *testing.T, n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
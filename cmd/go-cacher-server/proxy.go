@@ -0,0 +1,152 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/bradfitz/go-tool-cache/azblob"
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+// Flags for running as a pull-through proxy, mirroring go-cacher's.
+var (
+	originServer    = flag.String("cache-server", "", "optional origin go-cacher-server base URL; misses are fetched from it and writes forwarded to it, making this server a pull-through proxy. Namespaces use the origin's namespace of the same name.")
+	originTokenFile = flag.String("cache-server-token-file", "", "optional file containing a bearer token for -cache-server; $"+originTokenEnv+" takes precedence")
+	originBasicAuth = flag.String("cache-server-basic-auth-file", "", "optional file containing \"user:password\" for -cache-server; $"+originBasicAuthEnv+" takes precedence")
+	originCert      = flag.String("cache-server-cert", "", "optional TLS client certificate file for -cache-server")
+	originKey       = flag.String("cache-server-key", "", "TLS client key file for -cache-server-cert")
+	originCAFile    = flag.String("cache-server-ca-file", "", "optional PEM bundle of CA certificates to verify -cache-server with, instead of the system's")
+	remote          = flag.String("remote", "", "optional origin remote: azure or bazel. Only the default namespace uses it. If -cache-server is also set, it's consulted after it.")
+	upstreamPolicy  = flag.String("upstream-policy", "", "which operations to send to the origin: read-write, read-only, write-only or disabled; defaults to read-write")
+	forwardPuts     = flag.String("forward-puts", "sync", "how to forward writes to the origin: sync, replying once the origin has them, or async, replying once they're on local disk")
+	maxForwards     = flag.Int("forward-puts-max-pending", 1000, "with -forward-puts=async, how many writes may be in flight to the origin before further ones are forwarded before replying; 0 means no limit")
+	forwardTimeout  = flag.Duration("forward-puts-timeout", 10*time.Minute, "with -forward-puts=async, how long each write to the origin may take; 0 means no limit")
+	retries         = flag.Int("retries", 3, "maximum number of attempts for each origin call; 1 disables retries")
+
+	bazelURL = flag.String("bazel-url", "", "base URL of the Bazel HTTP cache for -remote=bazel")
+
+	azblobAccountName = flag.String("azblob-account-name", "", "Azure Blob Storage account name")
+	azblobAccountKey  = flag.String("azblob-account-key", "", "Azure Blob Storage account key")
+	azblobEndpoint    = flag.String("azblob-endpoint", "", "Azure Blob Storage endpoint")
+	azblobContainer   = flag.String("azblob-container", "", "Azure Blob Storage container")
+	azblobInlineMax   = flag.Int64("azblob-inline-max-size", 1024, "outputs of up to this many bytes are also embedded in their Azure action blobs, saving a request per Get; 0 disables")
+)
+
+// Environment variables holding -cache-server credentials, as for
+// go-cacher.
+const (
+	originTokenEnv     = "GOCACHER_SERVER_TOKEN"
+	originBasicAuthEnv = "GOCACHER_SERVER_BASIC_AUTH"
+)
+
+// newOrigin returns a WithUpstream, without its Local set, that proxies
+// namespace nsName to the configured origin, or nil if there's no origin
+// for it.
+func newOrigin(nsName string) (*cachers.WithUpstream, error) {
+	var tiers []cachers.Tier
+	if *originServer != "" {
+		token, err := cachers.LoadSecret(originTokenEnv, *originTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		user, password, err := cachers.LoadBasicAuth(originBasicAuthEnv, *originBasicAuth)
+		if err != nil {
+			return nil, fmt.Errorf("-cache-server: %w", err)
+		}
+		tiers = append(tiers, cachers.Tier{
+			Name: "cache-server",
+			Upstream: &cachers.HTTPRemote{
+				BaseURL:        *originServer,
+				Namespace:      nsName,
+				Verbose:        *verbose,
+				BearerToken:    token,
+				Username:       user,
+				Password:       password,
+				ClientCertFile: *originCert,
+				ClientKeyFile:  *originKey,
+				CAFile:         *originCAFile,
+			},
+		})
+	}
+	switch *remote {
+	case "":
+	case "azure":
+		// A container holds a single namespace.
+		if nsName == "" {
+			tiers = append(tiers, cachers.Tier{
+				Name: "azure",
+				Upstream: &azblob.CacheUpstream{
+					AccountName:   *azblobAccountName,
+					AccountKey:    *azblobAccountKey,
+					Endpoint:      *azblobEndpoint,
+					Container:     *azblobContainer,
+					InlineMaxSize: *azblobInlineMax,
+				},
+			})
+		}
+	case "bazel":
+		if *bazelURL == "" {
+			return nil, errors.New("-remote=bazel requires -bazel-url")
+		}
+		// Bazel caches have no namespaces either.
+		if nsName == "" {
+			tiers = append(tiers, cachers.Tier{
+				Name: "bazel",
+				Upstream: &cachers.BazelRemote{
+					BaseURL: *bazelURL,
+					Verbose: *verbose,
+				},
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unknown -remote %q", *remote)
+	}
+	if len(tiers) == 0 {
+		if *remote != "" && *verbose {
+			log.Printf("namespace %q has no origin", nsName)
+		}
+		return nil, nil
+	}
+	if *retries > 1 {
+		for i := range tiers {
+			tiers[i].Upstream = &cachers.RetryUpstream{
+				Upstream:    tiers[i].Upstream,
+				MaxAttempts: *retries,
+				Verbose:     *verbose,
+			}
+		}
+	}
+
+	policy, err := cachers.ParseUpstreamPolicy(*upstreamPolicy)
+	if err != nil {
+		return nil, err
+	}
+	wu := &cachers.WithUpstream{
+		Upstream: tiers[0].Upstream,
+		Policy:   policy,
+	}
+	if len(tiers) > 1 {
+		wu.Upstream = &cachers.TieredUpstream{
+			Tiers:    tiers,
+			Backfill: true,
+			Verbose:  *verbose,
+		}
+	}
+	switch *forwardPuts {
+	case "sync":
+	case "async":
+		wu.AsyncPuts = true
+		wu.MaxAsyncPuts = *maxForwards
+		wu.AsyncPutTimeout = *forwardTimeout
+	default:
+		return nil, fmt.Errorf("unknown -forward-puts %q; want sync or async", *forwardPuts)
+	}
+	return wu, nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProxyHeadOutput(t *testing.T) {
+	origin := newTestServer(t)
+	_, outputID := putOutput(t, origin, "a", strings.Repeat("x", 5000))
+	var gets atomic.Int32
+	ots := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/output/") {
+			gets.Add(1)
+		}
+		origin.ServeHTTP(w, r)
+	}))
+	defer ots.Close()
+
+	setFlag(t, originServer, ots.URL)
+	edge := newTestServer(t)
+	if got := do(t, edge, "HEAD", "/output/"+outputID, "").StatusCode; got != http.StatusOK {
+		t.Errorf("HEAD of an output only the origin has: %d; want 200", got)
+	}
+	if got := do(t, edge, "HEAD", "/output/"+sha256Hex("missing"), "").StatusCode; got != http.StatusNotFound {
+		t.Errorf("HEAD of a missing output: %d; want 404", got)
+	}
+	if n := gets.Load(); n != 0 {
+		t.Errorf("HEAD made %d GETs of the origin; want 0", n)
+	}
+	if n := mustOutputBytes(t, edge.root.disk.Dir); n != 0 {
+		t.Errorf("edge has %d bytes of outputs on disk after HEAD; want 0", n)
+	}
+
+	if got := do(t, edge, "GET", "/output/"+outputID, "").StatusCode; got != http.StatusOK {
+		t.Errorf("GET through the edge: %d; want 200", got)
+	}
+	if n := gets.Load(); n != 1 {
+		t.Errorf("GET made %d GETs of the origin; want 1", n)
+	}
+}
@@ -0,0 +1,189 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bradfitz/go-tool-cache/cachers"
+)
+
+// newTestServer returns a server storing its cache in a temporary
+// directory, configured from the flags as main does. Set flags with
+// setFlag before calling it.
+func newTestServer(t *testing.T) *server {
+	t.Helper()
+	setFlag(t, dir, t.TempDir())
+	srv := &server{
+		metrics:       newMetrics(),
+		verifyOutputs: *verifyOutputs,
+		maxObjectSize: *maxObjectSize,
+		inlineMaxSize: *inlineMaxSize,
+	}
+	if err := srv.configureNamespaces(); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.auth.configure(); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// do sends a request to h and returns the response.
+func do(t *testing.T, h http.Handler, method, path, body string, header ...string) *http.Response {
+	t.Helper()
+	var br io.Reader
+	if body != "" || method == "PUT" {
+		br = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, path, br)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w.Result()
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// putOutput stores data for an action named name and returns the action
+// and output IDs.
+func putOutput(t *testing.T, h http.Handler, name, data string, header ...string) (actionID, outputID string) {
+	t.Helper()
+	actionID, outputID = sha256Hex("action "+name), sha256Hex(data)
+	res := do(t, h, "PUT", fmt.Sprintf("/%s/%s", actionID, outputID), data, header...)
+	if res.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(res.Body)
+		t.Fatalf("PUT %s: %s: %s", name, res.Status, body)
+	}
+	return actionID, outputID
+}
+
+func TestCacheControl(t *testing.T) {
+	for _, authed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("auth=%v", authed), func(t *testing.T) {
+			var creds []string
+			if authed {
+				setFlag(t, tokenFile, writeFile(t, "read,write secret\n"))
+				creds = []string{"Authorization", "Bearer secret"}
+			}
+			srv := newTestServer(t)
+			actionID, outputID := putOutput(t, srv, "a", strings.Repeat("x", 2000), creds...)
+			want := "public"
+			if authed {
+				want = "private"
+			}
+			for _, path := range []string{"/action/" + actionID, "/output/" + outputID} {
+				res := do(t, srv, "GET", path, "", creds...)
+				if res.StatusCode != http.StatusOK {
+					t.Fatalf("GET %s: %s", path, res.Status)
+				}
+				if cc := res.Header.Get("Cache-Control"); !strings.HasPrefix(cc, want+",") {
+					t.Errorf("GET %s: Cache-Control = %q; want %s", path, cc, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPutCompressedLongerThanDeclared(t *testing.T) {
+	srv := newTestServer(t)
+	data := strings.Repeat("x", 1<<20)
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	io.WriteString(zw, data)
+	zw.Close()
+
+	actionID, outputID := sha256Hex("action a"), sha256Hex(data)
+	res := do(t, srv, "PUT", fmt.Sprintf("/%s/%s", actionID, outputID), buf.String(),
+		"Content-Encoding", "gzip",
+		cachers.SizeHeader, "100")
+	if res.StatusCode == http.StatusNoContent {
+		t.Fatalf("PUT of %d bytes declared as 100 succeeded", len(data))
+	}
+	if got := do(t, srv, "GET", "/action/"+actionID, ""); got.StatusCode != http.StatusNotFound {
+		t.Errorf("GET action after failed PUT: %s; want 404", got.Status)
+	}
+}
+
+func TestInlineData(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compress=%v", compress), func(t *testing.T) {
+			setFlag(t, compressAtRest, compress)
+			setFlag(t, inlineMaxSize, 1024)
+			srv := newTestServer(t)
+			tests := []struct {
+				name       string
+				data       string
+				wantInline bool
+			}{
+				{"small", strings.Repeat("s", 100), true},
+				{"at limit", strings.Repeat("l", 1024), true},
+				{"large", strings.Repeat("b", 1025), false},
+			}
+			for _, tt := range tests {
+				actionID, outputID := putOutput(t, srv, tt.name, tt.data)
+				res := do(t, srv, "GET", "/action/"+actionID, "")
+				var av cachers.ActionValue
+				if err := json.NewDecoder(res.Body).Decode(&av); err != nil {
+					t.Fatalf("%s: decoding action: %v", tt.name, err)
+				}
+				if av.OutputID != outputID || av.Size != int64(len(tt.data)) {
+					t.Errorf("%s: got %+v; want output %s of size %d", tt.name, av, outputID, len(tt.data))
+				}
+				if tt.wantInline && string(av.Data) != tt.data {
+					t.Errorf("%s: inline data = %q; want the output", tt.name, av.Data)
+				}
+				if !tt.wantInline && av.Data != nil {
+					t.Errorf("%s: got %d bytes of inline data; want none", tt.name, len(av.Data))
+				}
+			}
+		})
+	}
+}
+
+func TestGetOutput(t *testing.T) {
+	srv := newTestServer(t)
+	const data = "an output served from disk"
+	_, outputID := putOutput(t, srv, "a", data)
+
+	for _, method := range []string{"GET", "HEAD"} {
+		res := do(t, srv, method, "/output/"+outputID, "")
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("%s of a stored output: %s", method, res.Status)
+		}
+		if cl := res.Header.Get("Content-Length"); cl != fmt.Sprint(len(data)) {
+			t.Errorf("%s of a stored output: Content-Length = %q; want %d", method, cl, len(data))
+		}
+		body, _ := io.ReadAll(res.Body)
+		if method == "GET" && string(body) != data {
+			t.Errorf("GET of a stored output = %q; want %q", body, data)
+		}
+	}
+
+	missing := sha256Hex("never stored")
+	for _, method := range []string{"GET", "HEAD"} {
+		if res := do(t, srv, method, "/output/"+missing, ""); res.StatusCode != http.StatusNotFound {
+			t.Errorf("%s of a missing output: %s; want 404", method, res.Status)
+		}
+	}
+	if res := do(t, srv, "GET", "/output/not-hex", ""); res.StatusCode != http.StatusBadRequest {
+		t.Errorf("GET of a bad output ID: %s; want 400", res.Status)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// digestError is returned while reading an upload whose bytes don't match
+// its output ID or Content-Digest header.
+type digestError struct {
+	what string // "output ID" or a Content-Digest algorithm
+}
+
+func (e *digestError) Error() string {
+	return fmt.Sprintf("upload doesn't match its %s", e.what)
+}
+
+// contentDigest is an expected digest from a Content-Digest header
+// (RFC 9530).
+type contentDigest struct {
+	alg  string // "sha-256" or "sha-512"
+	want []byte
+	h    hash.Hash
+}
+
+// parseContentDigest parses a Content-Digest header value, like
+// "sha-256=:<base64>:, sha-512=:<base64>:". Algorithms other than sha-256
+// and sha-512 are ignored, as the RFC allows.
+func parseContentDigest(v string) ([]*contentDigest, error) {
+	var ds []*contentDigest
+	for _, f := range strings.Split(v, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		alg, val, ok := strings.Cut(f, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad Content-Digest member %q", f)
+		}
+		alg = strings.ToLower(strings.TrimSpace(alg))
+		var h hash.Hash
+		switch alg {
+		case "sha-256":
+			h = sha256.New()
+		case "sha-512":
+			h = sha512.New()
+		default:
+			continue
+		}
+		b64, ok := strings.CutPrefix(strings.TrimSpace(val), ":")
+		if b64, ok = strings.CutSuffix(b64, ":"); !ok {
+			return nil, fmt.Errorf("bad Content-Digest value for %s", alg)
+		}
+		want, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil || len(want) != h.Size() {
+			return nil, fmt.Errorf("bad Content-Digest value for %s", alg)
+		}
+		ds = append(ds, &contentDigest{alg: alg, want: want, h: h})
+	}
+	return ds, nil
+}
+
+// verifyingReader checks an upload as it's read, so a bad one fails the
+// write to the cache instead of being stored.
+//
+// Its Read returns a *digestError instead of io.EOF when the bytes don't
+// match. The Content-Digest is of the body as sent, before any content
+// encoding is undone, while the output ID is the SHA-256 of the decoded
+// output.
+type verifyingReader struct {
+	r       io.Reader // decoded body
+	raw     io.Reader // body as sent; read through r
+	digests []*contentDigest
+	output  hash.Hash // nil if not checking the output ID
+	wantID  []byte
+}
+
+// newVerifyingReader returns a reader of the decoded body, which is
+// decode(raw), that verifies it against the digests and, if wantOutputID is
+// non-empty, against that hex SHA-256.
+func newVerifyingReader(raw io.Reader, decode func(io.Reader) (io.Reader, error), digests []*contentDigest, wantOutputID string) (*verifyingReader, error) {
+	vr := &verifyingReader{digests: digests}
+	if len(digests) > 0 {
+		ws := make([]io.Writer, len(digests))
+		for i, d := range digests {
+			ws[i] = d.h
+		}
+		raw = io.TeeReader(raw, io.MultiWriter(ws...))
+	}
+	vr.raw = raw
+	r, err := decode(raw)
+	if err != nil {
+		return nil, err
+	}
+	if wantOutputID != "" {
+		want, err := hex.DecodeString(wantOutputID)
+		if err != nil || len(want) != sha256.Size {
+			return nil, &digestError{"output ID"}
+		}
+		vr.output, vr.wantID = sha256.New(), want
+		r = io.TeeReader(r, vr.output)
+	}
+	vr.r = r
+	return vr, nil
+}
+
+func (vr *verifyingReader) Read(p []byte) (int, error) {
+	n, err := vr.r.Read(p)
+	if err == io.EOF {
+		if verr := vr.verify(); verr != nil {
+			return n, verr
+		}
+	}
+	return n, err
+}
+
+// verify checks the digests once the decoded body has been read.
+func (vr *verifyingReader) verify() error {
+	if len(vr.digests) > 0 {
+		// A decoder may stop before the end of the raw body; hash the rest.
+		if _, err := io.Copy(io.Discard, vr.raw); err != nil {
+			return err
+		}
+		for _, d := range vr.digests {
+			if !bytes.Equal(d.h.Sum(nil), d.want) {
+				return &digestError{"Content-Digest " + d.alg}
+			}
+		}
+	}
+	if vr.output != nil && !bytes.Equal(vr.output.Sum(nil), vr.wantID) {
+		return &digestError{"output ID"}
+	}
+	return nil
+}
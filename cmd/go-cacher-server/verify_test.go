@@ -0,0 +1,63 @@
+// Copyright 2023 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestVerifyUploads(t *testing.T) {
+	const data = "output bytes"
+	sum256 := sha256.Sum256([]byte(data))
+	sum512 := sha512.Sum512([]byte(data))
+	good256 := "sha-256=:" + base64.StdEncoding.EncodeToString(sum256[:]) + ":"
+	good512 := "sha-512=:" + base64.StdEncoding.EncodeToString(sum512[:]) + ":"
+	bad256 := "sha-256=:" + base64.StdEncoding.EncodeToString(make([]byte, 32)) + ":"
+
+	tests := []struct {
+		name     string
+		verify   bool
+		outputID string
+		digest   string
+		want     int
+	}{
+		{"no checks", false, sha256Hex("other"), "", http.StatusNoContent},
+		{"good sha-256", false, sha256Hex(data), good256, http.StatusNoContent},
+		{"good sha-512", false, sha256Hex(data), good512, http.StatusNoContent},
+		{"both, one bad", false, sha256Hex(data), good512 + ", " + bad256, http.StatusBadRequest},
+		{"bad sha-256", false, sha256Hex(data), bad256, http.StatusBadRequest},
+		{"unknown algorithm ignored", false, sha256Hex(data), "md5=:AAAA:", http.StatusNoContent},
+		{"malformed", false, sha256Hex(data), "sha-256", http.StatusBadRequest},
+		{"verify good ID", true, sha256Hex(data), "", http.StatusNoContent},
+		{"verify bad ID", true, sha256Hex("other"), "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setFlag(t, verifyOutputs, tt.verify)
+			srv := newTestServer(t)
+			actionID := sha256Hex("action")
+			var header []string
+			if tt.digest != "" {
+				header = []string{"Content-Digest", tt.digest}
+			}
+			res := do(t, srv, "PUT", fmt.Sprintf("/%s/%s", actionID, tt.outputID), data, header...)
+			if res.StatusCode != tt.want {
+				t.Fatalf("PUT: %s; want %d", res.Status, tt.want)
+			}
+			wantAction := http.StatusOK
+			if tt.want != http.StatusNoContent {
+				wantAction = http.StatusNotFound
+			}
+			if got := do(t, srv, "GET", "/action/"+actionID, "").StatusCode; got != wantAction {
+				t.Errorf("GET action: %d; want %d", got, wantAction)
+			}
+		})
+	}
+}
@@ -6,10 +6,14 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"log"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/bradfitz/go-tool-cache/azblob"
 	"github.com/bradfitz/go-tool-cache/cacheproc"
@@ -18,18 +22,86 @@ import (
 
 var (
 	dir        = flag.String("cache-dir", "", "cache directory; empty means automatic")
-	serverBase = flag.String("cache-server", "", "optional cache server HTTP prefix (scheme and authority only); should be low latency. empty means to not use one.")
+	serverBase = flag.String("cache-server", "", "optional cache server HTTP prefix (scheme and authority only), or unix:///path/to/socket; should be low latency. empty means to not use one. A comma-separated list shards the cache across those servers.")
 	verbose    = flag.Bool("verbose", false, "be verbose")
-	remote = flag.String("remote", "", "remote to use. Defaults to disabled. Valid values are: azure")
+	remote     = flag.String("remote", "", "remote to use. Defaults to disabled. Valid values are: azure, bazel")
+	policy     = flag.String("upstream-policy", os.Getenv(policyEnv), "which operations to send to the remote or cache server: read-write, read-only, write-only or disabled. Defaults to $"+policyEnv+", then read-write.")
+
+	serverTokenFile     = flag.String("cache-server-token-file", "", "optional file containing a bearer token for -cache-server; $"+serverTokenEnv+" takes precedence")
+	serverBasicAuthFile = flag.String("cache-server-basic-auth-file", "", "optional file containing \"user:password\" for -cache-server; $"+serverBasicAuthEnv+" takes precedence")
+	serverBatchWindow   = flag.Duration("cache-server-batch-window", 0, "if non-zero, coalesce -cache-server action lookups arriving within this window into one request")
+	serverNamespace     = flag.String("cache-server-namespace", "", "optional -cache-server namespace, such as main or pr; empty means the server's default namespace")
+	serverHTTP2         = flag.Bool("cache-server-http2", false, "use HTTP/2 to -cache-server, multiplexing requests over few connections; cleartext servers must be run with -h2c, and are then reached directly, without -cache-server-proxy")
+	serverCompression   = flag.String("cache-server-compression", "", "optional content encoding for -cache-server transfers: gzip or zstd")
+	serverHedge         = flag.Bool("cache-server-hedge", false, "send a duplicate -cache-server lookup or download, to the same server, when the first is slower than most recent ones, using whichever answers first")
+	serverReplicas      = flag.Int("cache-server-replicas", 1, "with several -cache-server URLs, how many of them to store each entry on")
+	serverCert          = flag.String("cache-server-cert", "", "optional TLS client certificate file for -cache-server")
+	serverKey           = flag.String("cache-server-key", "", "TLS client key file for -cache-server-cert")
+	serverCAFile        = flag.String("cache-server-ca-file", "", "optional PEM bundle of CA certificates to verify -cache-server with, instead of the system's")
+	serverProxy         = flag.String("cache-server-proxy", "", "optional HTTP proxy URL for -cache-server, or \"direct\" for none; empty means from $HTTPS_PROXY and friends")
+	serverIdleConns     = flag.Int("cache-server-max-idle-conns", 32, "idle connections to keep open to each -cache-server, for parallel lookups and downloads")
+
+	serverDialTimeout   = flag.Duration("cache-server-dial-timeout", 30*time.Second, "how long connecting to -cache-server may take")
+	serverTLSTimeout    = flag.Duration("cache-server-tls-timeout", 10*time.Second, "how long the TLS handshake with -cache-server may take")
+	serverHeaderTimeout = flag.Duration("cache-server-response-header-timeout", 0, "if non-zero, how long to wait for -cache-server to start responding to a request")
+
+	retries      = flag.Int("retries", 3, "maximum number of attempts for each remote or cache server call; 1 disables retries")
+	retryTimeout = flag.Duration("retry-timeout", time.Minute, "deadline for each remote or cache server lookup, including its retries; it doesn't apply to reading downloaded outputs or to uploads. 0 means none")
+
+	putMinSize = flag.Int64("put-min-size", 0, "outputs smaller than this many bytes aren't uploaded to the remote or cache server")
+	putMaxSize = flag.Int64("put-max-size", 0, "outputs larger than this many bytes aren't uploaded to the remote or cache server; 0 means no limit")
+	getMaxSize = flag.Int64("get-max-size", 0, "outputs larger than this many bytes aren't downloaded from the remote or cache server; 0 means no limit")
+
+	getActionTimeout = flag.Duration("get-action-timeout", 0, "if non-zero, how long a build waits for an action lookup from the remote or cache server before treating it as a miss; the lookup and download then finish in the background")
+	getOutputTimeout = flag.Duration("get-output-timeout", 0, "if non-zero, how long a build waits for an output download before treating it as a miss and letting it finish in the background")
+	closeTimeout     = flag.Duration("close-timeout", time.Minute, "when the go command exits, how long to wait for background uploads and downloads to finish; 0 means no limit")
+	getOutputRate    = flag.Int64("get-output-rate", 0, "if non-zero, bytes per second of expected download speed; -get-output-timeout is extended by each output's size at this rate")
+
+	backfill        = flag.Bool("backfill", true, "when both -cache-server and -remote are set, copy entries found only in the remote into the cache server")
+	putTiers        = flag.String("put-tiers", "", "comma-separated tiers to write to (cache-server, azure, bazel); empty means all")
+	bestEffortTiers = flag.String("best-effort-tiers", "", "comma-separated tiers whose write errors are logged instead of failing the put")
+
+	bazelURL = flag.String("bazel-url", "", "base URL of the Bazel HTTP cache for -remote=bazel, such as bazel-remote; credentials may be given as user:password@ in the URL")
 
 	azblobAccountName = flag.String("azblob-account-name", "", "Azure Blob Storage account name")
 	azblobAccountKey  = flag.String("azblob-account-key", "", "Azure Blob Storage account key")
 	azblobEndpoint    = flag.String("azblob-endpoint", "", "Azure Blob Storage endpoint")
 	azblobContainer   = flag.String("azblob-container", "", "Azure Blob Storage container")
+	azblobInlineMax   = flag.Int64("azblob-inline-max-size", 1024, "outputs of up to this many bytes are also embedded in their Azure action blobs, saving a request per Get; 0 disables")
+)
+
+// serverHeaders holds the -cache-server-header flags.
+var serverHeaders = http.Header{}
+
+func init() {
+	flag.Func("cache-server-header", "header to send with every -cache-server request, as \"Name: value\"; may be repeated", func(v string) error {
+		name, value, ok := strings.Cut(v, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return errors.New("want \"Name: value\"")
+		}
+		serverHeaders.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+		return nil
+	})
+}
+
+// policyEnv is the environment variable that sets the default for the
+// -upstream-policy flag, so a policy can be chosen per process without
+// changing GOCACHEPROG.
+const policyEnv = "GOCACHER_UPSTREAM_POLICY"
+
+// Environment variables holding -cache-server credentials, so they stay out
+// of GOCACHEPROG.
+const (
+	serverTokenEnv     = "GOCACHER_SERVER_TOKEN"
+	serverBasicAuthEnv = "GOCACHER_SERVER_BASIC_AUTH"
 )
 
 func main() {
 	flag.Parse()
+	upstreamPolicy, err := cachers.ParseUpstreamPolicy(*policy)
+	if err != nil {
+		log.Fatal(err)
+	}
 	if *dir == "" {
 		d, err := os.UserCacheDir()
 		if err != nil {
@@ -43,31 +115,175 @@ func main() {
 		log.Fatal(err)
 	}
 
-	var cache cachers.Cache
-
 	dc := &cachers.DiskCache{Dir: *dir, Verbose: *verbose}
 
+	// Tiers are ordered fastest first: the cache server is expected to be
+	// low latency, and the remote is the durable store behind it.
+	var tiers []cachers.Tier
+	var remotes []*cachers.HTTPRemote
+	if *serverBase != "" {
+		if *serverCompression != "" && !cachers.ValidEncoding(*serverCompression) {
+			log.Fatalf("unsupported -cache-server-compression %q", *serverCompression)
+		}
+		token, err := cachers.LoadSecret(serverTokenEnv, *serverTokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		user, password, err := cachers.LoadBasicAuth(serverBasicAuthEnv, *serverBasicAuthFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		newRemote := func(base string) *cachers.HTTPRemote {
+			hr := &cachers.HTTPRemote{
+				BaseURL:        base,
+				Namespace:      *serverNamespace,
+				PreferHTTP2:    *serverHTTP2,
+				Verbose:        *verbose,
+				BearerToken:    token,
+				Username:       user,
+				Password:       password,
+				ClientCertFile: *serverCert,
+				ClientKeyFile:  *serverKey,
+				BatchWindow:    *serverBatchWindow,
+				Compression:    *serverCompression,
+				Hedge:          *serverHedge,
+
+				DialTimeout:           *serverDialTimeout,
+				TLSHandshakeTimeout:   *serverTLSTimeout,
+				ResponseHeaderTimeout: *serverHeaderTimeout,
+				MaxIdleConnsPerHost:   *serverIdleConns,
+				Proxy:                 *serverProxy,
+				Headers:               serverHeaders,
+				CAFile:                *serverCAFile,
+			}
+			remotes = append(remotes, hr)
+			return hr
+		}
+		var bases []string
+		for _, base := range strings.Split(*serverBase, ",") {
+			if base = strings.TrimSpace(base); base != "" {
+				bases = append(bases, base)
+			}
+		}
+		if len(bases) == 0 {
+			log.Fatalf("-cache-server %q has no URLs", *serverBase)
+		}
+		if *serverReplicas < 1 || *serverReplicas > len(bases) {
+			log.Fatalf("-cache-server-replicas=%d; want between 1 and the %d -cache-server URLs", *serverReplicas, len(bases))
+		}
+		var up cachers.Upstream
+		if len(bases) > 1 {
+			su := &cachers.ShardedUpstream{
+				Replicas: *serverReplicas,
+				Verbose:  *verbose,
+			}
+			for _, base := range bases {
+				su.Shards = append(su.Shards, cachers.Shard{
+					Name:     base,
+					Upstream: newRemote(base),
+				})
+			}
+			up = su
+		} else {
+			up = newRemote(bases[0])
+		}
+		tiers = append(tiers, cachers.Tier{
+			Name:     "cache-server",
+			Upstream: up,
+		})
+	}
 	switch *remote {
-		case "azure":
-			cache = &cachers.WithUpstream{
-				Upstream: &azblob.CacheUpstream{
-					AccountName: *azblobAccountName,
-					AccountKey:  *azblobAccountKey,
-					Endpoint:    *azblobEndpoint,
-					Container:   *azblobContainer,
-				},
-				Local: dc,
+	case "":
+	case "azure":
+		tiers = append(tiers, cachers.Tier{
+			Name: "azure",
+			Upstream: &azblob.CacheUpstream{
+				AccountName:   *azblobAccountName,
+				AccountKey:    *azblobAccountKey,
+				Endpoint:      *azblobEndpoint,
+				Container:     *azblobContainer,
+				InlineMaxSize: *azblobInlineMax,
+			},
+		})
+	case "bazel":
+		if *bazelURL == "" {
+			log.Fatalf("-remote=bazel requires -bazel-url")
+		}
+		tiers = append(tiers, cachers.Tier{
+			Name: "bazel",
+			Upstream: &cachers.BazelRemote{
+				BaseURL: *bazelURL,
+				Verbose: *verbose,
+			},
+		})
+	default:
+		log.Fatalf("unknown -remote %q", *remote)
+	}
+	if *retries > 1 {
+		for i := range tiers {
+			tiers[i].Upstream = &cachers.RetryUpstream{
+				Upstream:    tiers[i].Upstream,
+				MaxAttempts: *retries,
+				CallTimeout: *retryTimeout,
+				Verbose:     *verbose,
+			}
+		}
+	}
+	putTierNames := nameSet("put-tiers", *putTiers)
+	bestEffortNames := nameSet("best-effort-tiers", *bestEffortTiers)
+	for i := range tiers {
+		t := &tiers[i]
+		t.NoPut = len(putTierNames) > 0 && !putTierNames[t.Name]
+		t.IgnorePutErrors = bestEffortNames[t.Name]
+	}
+
+	var cache cachers.Cache = dc
+	var wu *cachers.WithUpstream
+	if len(tiers) > 0 {
+		wu = &cachers.WithUpstream{
+			Upstream:   tiers[0].Upstream,
+			Local:      dc,
+			Policy:     upstreamPolicy,
+			PutMinSize: *putMinSize,
+			PutMaxSize: *putMaxSize,
+			GetMaxSize: *getMaxSize,
+
+			GetActionTimeout: *getActionTimeout,
+			GetOutputTimeout: *getOutputTimeout,
+			GetOutputRate:    *getOutputRate,
+
+			Verbose: *verbose,
+		}
+		if len(tiers) > 1 || tiers[0].NoPut || tiers[0].IgnorePutErrors {
+			wu.Upstream = &cachers.TieredUpstream{
+				Tiers:    tiers,
+				Backfill: *backfill,
+				Verbose:  *verbose,
 			}
-		default:
-			cache = dc
+		}
+		cache = wu
 	}
 
 	var p *cacheproc.Process
 	p = &cacheproc.Process{
 		Close: func() error {
+			if wu != nil {
+				// Let background writes and downloads finish, so the next
+				// build can use them, unless they're stuck.
+				waitClose(wu, *closeTimeout)
+			}
 			if *verbose {
 				log.Printf("cacher: closing; %d gets (%d hits, %d misses, %d errors); %d puts (%d errors)",
 					p.Gets.Load(), p.GetHits.Load(), p.GetMisses.Load(), p.GetErrors.Load(), p.Puts.Load(), p.PutErrors.Load())
+				if wu != nil {
+					log.Printf("cacher: skipped by size: %d remote gets, %d remote puts; %d gets finished in the background",
+						wu.SkippedGets.Load(), wu.SkippedPuts.Load(), wu.BackgroundGets.Load())
+				}
+				for _, hr := range remotes {
+					if hr.Hedge {
+						log.Printf("cacher: %s: %d hedged requests, %d won", hr.BaseURL, hr.HedgesSent.Load(), hr.HedgesWon.Load())
+					}
+				}
 			}
 			return nil
 		},
@@ -75,19 +291,45 @@ func main() {
 		Put: cache.Put,
 	}
 
-	if *serverBase != "" {
-		hc := &cachers.WithUpstream{
-			Upstream: &cachers.HTTPRemote{
-				BaseURL: *serverBase,
-				Verbose: *verbose,
-			},
-			Local: dc,
+	if err := p.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// tierNames are the names of the tiers -put-tiers and -best-effort-tiers
+// can refer to.
+var tierNames = map[string]bool{"cache-server": true, "azure": true, "bazel": true}
+
+// nameSet parses the comma-separated list of tier names in the flag named
+// flagName into a set, exiting if it names an unknown tier.
+func nameSet(flagName, s string) map[string]bool {
+	m := map[string]bool{}
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			if !tierNames[f] {
+				log.Fatalf("-%s: unknown tier %q; want cache-server, azure or bazel", flagName, f)
+			}
+			m[f] = true
 		}
-		p.Get = hc.Get
-		p.Put = hc.Put
 	}
+	return m
+}
 
-	if err := p.Run(); err != nil {
-		log.Fatal(err)
+// waitClose waits up to timeout, or forever if it's zero, for wu's
+// background work to finish.
+func waitClose(wu *cachers.WithUpstream, timeout time.Duration) {
+	if timeout <= 0 {
+		wu.Wait()
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		wu.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("cacher: gave up waiting for background uploads and downloads after %v", timeout)
 	}
 }
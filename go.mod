@@ -2,13 +2,16 @@ module github.com/bradfitz/go-tool-cache
 
 go 1.20
 
-require github.com/Azure/azure-storage-blob-go v0.15.0
+require (
+	github.com/Azure/azure-storage-blob-go v0.15.0
+	github.com/klauspost/compress v1.17.9
+	golang.org/x/net v0.35.0
+)
 
 require (
 	github.com/Azure/azure-pipeline-go v0.2.3 // indirect
 	github.com/google/uuid v1.2.0 // indirect
 	github.com/mattn/go-ieproxy v0.0.1 // indirect
-	golang.org/x/net v0.0.0-20210610132358-84b48f89b13b // indirect
-	golang.org/x/sys v0.0.0-20210423082822-04245dca01da // indirect
-	golang.org/x/text v0.3.6 // indirect
+	golang.org/x/sys v0.30.0 // indirect
+	golang.org/x/text v0.22.0 // indirect
 )